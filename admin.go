@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// backupHandler streams every post, soft deleted ones included, so the
+// output can be piped straight to a file and fed back to the restore
+// endpoint. It's a JSON array by default, ?format=ndjson gives one post
+// per line instead.
+func (s *server) backupHandler(w http.ResponseWriter, r *http.Request) {
+	ndjson := false
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+	case "ndjson":
+		ndjson = true
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_format", "Invalid format, supported formats are json and ndjson")
+		return
+	}
+
+	ps, err := s.snapshot(r.Context())
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="posts.ndjson"`)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="posts.json"`)
+	}
+
+	// Posts are marshalled one at a time, so the response never has to
+	// fit in memory as a single buffer
+	for i, p := range ps {
+		b, err := json.Marshal(p)
+		if err != nil {
+			// The status has been sent by now, so the best we can do is
+			// cut the connection so the client can't mistake this for a
+			// full backup
+			logger.Println("error writing backup:", err)
+			panic(http.ErrAbortHandler)
+		}
+		switch {
+		case ndjson:
+			b = append(b, '\n')
+		case i == 0:
+			b = append([]byte("[\n"), b...)
+		default:
+			b = append([]byte(",\n"), b...)
+		}
+		if _, err := w.Write(b); err != nil {
+			return
+		}
+	}
+
+	if !ndjson {
+		end := "\n]\n"
+		if len(ps) == 0 {
+			end = "[]\n"
+		}
+		w.Write([]byte(end))
+	}
+}
+
+// snapshot copies every post out of the store's Export. Writing to a
+// client from inside Export would hold the store's lock, or SQLite's only
+// connection, for as long as the client takes to read, so handlers take
+// the copy first and send it once Export has returned.
+func (s *server) snapshot(ctx context.Context) ([]Post, error) {
+	var ps []Post
+	err := s.store.Export(ctx, func(p Post) error {
+		ps = append(ps, p)
+		return nil
+	})
+	return ps, err
+}
+
+// restoreHandler replaces every post with the ones in the request body,
+// in either of the formats backupHandler writes. Every entry is checked
+// before anything is touched, so a bad file is rejected as a whole rather
+// than half applied. Uploaded files of posts that aren't in the backup are
+// deleted.
+func (s *server) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var ps []Post
+	if contentType(r) == "application/x-ndjson" {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		for {
+			var p Post
+			if err := dec.Decode(&p); err == io.EOF {
+				break
+			} else if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing request body: "+err.Error())
+				return
+			}
+			ps = append(ps, p)
+		}
+	} else if err := json.Unmarshal(body, &ps); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing request body: "+err.Error())
+		return
+	}
+
+	seen := make(map[string]bool, len(ps))
+	slugs := make(map[string]bool, len(ps))
+	for i, p := range ps {
+		var e APIError
+		switch {
+		case p.ID == "":
+			e = APIError{Code: "invalid_post", Message: "id must not be empty", Field: "id"}
+		case seen[p.ID]:
+			e = APIError{Code: "invalid_post", Message: "id " + p.ID + " appears more than once", Field: "id"}
+		case p.Slug != "" && slugs[p.Slug]:
+			e = APIError{Code: "invalid_post", Message: "slug " + p.Slug + " appears more than once", Field: "slug"}
+		default:
+			if err := validatePost(p); err != nil {
+				e = validationAPIError(err)
+			}
+		}
+		if e.Code != "" {
+			e.Index = &i
+			writeAPIError(w, http.StatusUnprocessableEntity, e)
+			return
+		}
+		seen[p.ID] = true
+		slugs[p.Slug] = true
+	}
+
+	replaced, err := s.store.Import(r.Context(), ps)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.deleteAttachments(r.Context(), replaced, ps)
+	s.recordAudit(r, "import", postIDs(ps)...)
+	s.publishReset(r)
+	writeJSON(w, http.StatusOK, map[string]int{"restored": len(ps)})
+}
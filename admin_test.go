@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	h := newTestServer(t)
+	if rec := do(h, "GET", "/admin/backup", ""); rec.Code != http.StatusOK || rec.Body.String() != "[]\n" {
+		t.Errorf("empty backup = %d %q", rec.Code, rec.Body)
+	}
+
+	createPost(t, h, "kept")
+	gone := createPost(t, h, "deleted")
+	do(h, "DELETE", "/post/"+gone.ID, "")
+
+	// Soft deleted posts are part of the backup
+	rec := do(h, "GET", "/admin/backup", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("backup = %d %s", rec.Code, rec.Body)
+	}
+	if ps := decode[[]Post](t, rec); len(ps) != 2 {
+		t.Errorf("backup has %d posts, want 2", len(ps))
+	}
+
+	rec = do(h, "GET", "/admin/backup?format=ndjson", "")
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("ndjson Content-Type = %q", ct)
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("ndjson backup has %d lines, want 2", len(lines))
+	}
+	for _, line := range lines {
+		var p Post
+		if err := json.Unmarshal([]byte(line), &p); err != nil || p.ID == "" {
+			t.Errorf("ndjson line %q: %v", line, err)
+		}
+	}
+
+	if rec := do(h, "GET", "/admin/backup?format=xml", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("backup in an unknown format = %d, want 400", rec.Code)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	h := newTestServer(t)
+	a := createPost(t, h, "a")
+	b := createPost(t, h, "b")
+	backup := do(h, "GET", "/admin/backup?format=ndjson", "").Body.String()
+
+	do(h, "DELETE", "/post/"+a.ID, "")
+	c := createPost(t, h, "c")
+
+	rec := do(h, "POST", "/admin/restore", backup, "Content-Type", "application/x-ndjson")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore = %d %s", rec.Code, rec.Body)
+	}
+	if n := decode[map[string]int](t, rec)["restored"]; n != 2 {
+		t.Errorf("restored %d posts, want 2", n)
+	}
+	for id, want := range map[string]int{a.ID: http.StatusOK, b.ID: http.StatusOK, c.ID: http.StatusNotFound} {
+		if rec := do(h, "GET", "/post/"+id, ""); rec.Code != want {
+			t.Errorf("GET %s after restore = %d, want %d", id, rec.Code, want)
+		}
+	}
+
+	// A file with one bad entry is rejected without touching anything
+	rec = do(h, "POST", "/admin/restore", `[{"id":"x","title":"T","body":"fine"},{"id":"x","title":"T","body":"again"}]`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("restore with a repeated ID = %d, want 422", rec.Code)
+	}
+	if e := decode[struct{ Error APIError }](t, rec); e.Error.Index == nil || *e.Error.Index != 1 {
+		t.Errorf("restore error index = %v, want 1", e.Error.Index)
+	}
+	if rec := do(h, "GET", "/post/"+a.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("rejected restore removed %s", a.ID)
+	}
+}
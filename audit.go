@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog is an append-only record of every change to posts: who made
+// it, when and to which post. The access log says which requests came
+// in, this says what they did, so it goes to a file of its own.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// auditEvent is one line of the audit log.
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	PostID    string    `json:"post_id,omitempty"`
+	Method    string    `json:"method,omitempty"`
+	Path      string    `json:"path,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{f: f}, nil
+}
+
+// write appends e and syncs the file, so an event we've been told about
+// is on disk before the client hears the change went through.
+func (a *auditLog) write(e auditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+func (a *auditLog) Close() error {
+	return a.f.Close()
+}
+
+// recordAudit logs action on each of the posts in ids, or once without a
+// post for actions like delete_all. The change has already been made by
+// the time we get here, so a failed write can't undo it, it's logged as
+// an error instead.
+func (s *server) recordAudit(r *http.Request, action string, ids ...string) {
+	s.writeAudit(auditEvent{
+		Action:    action,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Subject:   subjectFrom(r.Context()),
+		Tenant:    tenantFrom(r.Context()),
+		RequestID: requestIDFrom(r.Context()),
+	}, ids)
+}
+
+// recordServerAudit is recordAudit for changes the server makes by itself,
+// like the expiry sweep, which have no request and no client behind them.
+// ctx says which tenant's posts they were.
+func (s *server) recordServerAudit(ctx context.Context, action string, ids ...string) {
+	s.writeAudit(auditEvent{Action: action, Tenant: tenantFrom(ctx)}, ids)
+}
+
+func (s *server) writeAudit(e auditEvent, ids []string) {
+	if s.audit == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	if len(ids) == 0 {
+		ids = []string{""}
+	}
+	for _, id := range ids {
+		e.PostID = id
+		if err := s.audit.write(e); err != nil {
+			logger.Printf("error writing audit log, lost %s of post %q by %q: %v", e.Action, id, e.Subject, err)
+		}
+	}
+}
+
+// postIDs returns the IDs of ps, for recordAudit.
+func postIDs(ps []Post) []string {
+	ids := make([]string, len(ps))
+	for i, p := range ps {
+		ids[i] = p.ID
+	}
+	return ids
+}
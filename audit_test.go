@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	h := asSubject("ann", newTestServer(t, func(s *server) { s.audit = a }))
+
+	p := createPost(t, h, "Audited")
+	do(h, "PUT", "/post/"+p.ID, `{"title":"T","body":"changed"}`)
+	do(h, "DELETE", "/post/"+p.ID, "")
+	do(h, "POST", "/post/"+p.ID+"/restore", "")
+	// Reads and failed writes aren't changes
+	do(h, "GET", "/post/"+p.ID, "")
+	do(h, "PUT", "/post/missing", `{"title":"T","body":"x"}`)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var actions []string
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e auditEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("audit line %q: %v", sc.Text(), err)
+		}
+		if e.PostID != p.ID || e.Subject != "ann" {
+			t.Errorf("event %+v isn't about %s by ann", e, p.ID)
+		}
+		actions = append(actions, e.Action)
+	}
+	if want := []string{"create", "update", "delete", "restore"}; !slices.Equal(actions, want) {
+		t.Errorf("audited %v, want %v", actions, want)
+	}
+}
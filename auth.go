@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// isReadMethod reports whether method only reads data. Auth middleware
+// lets these through so the API stays publicly readable.
+func isReadMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+const authRequiredKey contextKey = "auth_required"
+
+// withAuthRequired marks requests so the auth middleware checks reads as
+// well as writes. It has to wrap the auth middleware to have any effect.
+// Admin routes use it, reading a backup is as sensitive as writing one.
+func withAuthRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authRequiredKey, true)))
+	})
+}
+
+// withReadAuth applies withAuthRequired to every route when required is
+// set, for -private-posts, where what a read returns depends on who's
+// asking.
+func withReadAuth(required bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		if !required {
+			return next
+		}
+		return withAuthRequired(next)
+	}
+}
+
+// isPublicRead reports whether r may skip authentication.
+func isPublicRead(r *http.Request) bool {
+	required, _ := r.Context().Value(authRequiredKey).(bool)
+	return isReadMethod(r.Method) && !required
+}
+
+// withBasicAuth requires HTTP Basic credentials matching user and password
+// for any request that can change data, and for reads on routes wrapped in
+// withAuthRequired. If no user is configured it does nothing, which keeps
+// local development friction free.
+func withBasicAuth(user, password string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if user == "" {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isPublicRead(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			u, p, ok := r.BasicAuth()
+			// Compare both halves even if the first fails so the response
+			// time doesn't hint at which one was wrong
+			userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+			passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+			if !ok || !userOK || !passOK {
+				w.Header().Set("WWW-Authenticate", `Basic realm="posts", charset="UTF-8"`)
+				writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+				return
+			}
+
+			next.ServeHTTP(w, withSubject(r, u))
+		})
+	}
+}
+
+// withAPIKey requires every request to carry key in the X-API-Key header.
+// OPTIONS is exempt since browsers never send custom headers on preflight
+// requests. If no key is configured it does nothing.
+func withAPIKey(key string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if key == "" {
+			return next
+		}
+		// Hashing both sides first means the comparison always looks at the
+		// same number of bytes, so it doesn't leak the key's length either
+		want := sha256.Sum256([]byte(key))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "OPTIONS" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			got := sha256.Sum256([]byte(r.Header.Get("X-API-Key")))
+			if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+				writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Comment is one entry in a post's discussion thread.
+type Comment struct {
+	ID        string    `json:"id"`
+	PostID    string    `json:"post_id"`
+	Author    string    `json:"author,omitempty"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// newComment fills in the server controlled fields of a comment about to
+// be added to the post with the given ID.
+func newComment(postID string, c Comment) Comment {
+	c.ID = uuid.NewString()
+	c.PostID = postID
+	c.CreatedAt = time.Now().UTC()
+	return c
+}
+
+// validateComment checks the fields clients control.
+func validateComment(c Comment) error {
+	if strings.TrimSpace(c.Body) == "" {
+		return &ValidationError{Field: "body", Message: "must not be empty"}
+	}
+	return nil
+}
+
+// handleListComments lists a post's comments, oldest first.
+func (s *server) handleListComments(w http.ResponseWriter, r *http.Request, id string) {
+	if err := s.checkRead(r.Context(), id); err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	cs, err := s.store.ListComments(r.Context(), id)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cs)
+}
+
+// handleAddComment adds a comment to a post.
+func (s *server) handleAddComment(w http.ResponseWriter, r *http.Request, id string) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var c Comment
+	if err := json.Unmarshal(body, &c); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing request body")
+		return
+	}
+	if err := validateComment(c); err != nil {
+		e := validationAPIError(err)
+		e.Code = "invalid_comment"
+		writeAPIError(w, http.StatusUnprocessableEntity, e)
+		return
+	}
+
+	c.Author = strings.TrimSpace(c.Author)
+	if c.Author == "" {
+		c.Author = subjectFrom(r.Context())
+	}
+
+	if err := s.checkRead(r.Context(), id); err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	c, err := s.store.AddComment(r.Context(), id, c)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, c)
+}
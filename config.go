@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every setting the server takes. Each one comes from its flag
+// if that's given, otherwise from its environment variable, otherwise
+// from the -config file, otherwise it's the default. Secrets have no flag
+// so they don't show up in ps, only an environment variable and the file.
+//
+// The flag and env tags say which flag and variable set a field, load
+// needs them to tell which file values have been overridden.
+type Config struct {
+	Addr              string        `yaml:"addr" flag:"addr" env:"ADDR"`
+	TLSCert           string        `yaml:"tls_cert" flag:"tls-cert" env:"TLS_CERT_FILE"`
+	TLSKey            string        `yaml:"tls_key" flag:"tls-key" env:"TLS_KEY_FILE"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" flag:"read-header-timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" flag:"read-timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" flag:"write-timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" flag:"idle-timeout"`
+	LogFormat         string        `yaml:"log_format" flag:"log-format" env:"LOG_FORMAT"`
+
+	CORSOrigins   string  `yaml:"cors_origins" flag:"cors-origins" env:"CORS_ORIGINS"`
+	RateLimit     float64 `yaml:"rate_limit" flag:"rate-limit"`
+	RateBurst     int     `yaml:"rate_burst" flag:"rate-burst"`
+	MaxConcurrent int     `yaml:"max_concurrent" flag:"max-concurrent"`
+	TrustProxy    bool    `yaml:"trust_proxy" flag:"trust-proxy"`
+	MaxBody       int64   `yaml:"max_body" flag:"max-body" env:"MAX_BODY_BYTES"`
+
+	Store          string        `yaml:"store" flag:"store"`
+	Data           string        `yaml:"data" flag:"data"`
+	Tenants        string        `yaml:"tenants" flag:"tenants" env:"TENANTS"`
+	MaxRevisions   int           `yaml:"max_revisions" flag:"max-revisions" env:"MAX_REVISIONS"`
+	MaxPosts       int           `yaml:"max_posts" flag:"max-posts" env:"MAX_POSTS"`
+	ExpirySweep    time.Duration `yaml:"expiry_sweep" flag:"expiry-sweep" env:"EXPIRY_SWEEP"`
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl" flag:"idempotency-ttl"`
+	CountViews     bool          `yaml:"count_views" flag:"count-views" env:"COUNT_VIEWS"`
+	AllowDeleteAll bool          `yaml:"allow_delete_all" flag:"allow-delete-all" env:"ALLOW_DELETE_ALL"`
+	PrivatePosts   bool          `yaml:"private_posts" flag:"private-posts" env:"PRIVATE_POSTS"`
+	ReadOnly       bool          `yaml:"readonly" flag:"readonly" env:"READONLY"`
+	AuditLog       string        `yaml:"audit_log" flag:"audit-log" env:"AUDIT_LOG"`
+
+	Storage     string        `yaml:"storage" flag:"storage" env:"STORAGE"`
+	UploadDir   string        `yaml:"upload_dir" flag:"upload-dir" env:"UPLOAD_DIR"`
+	MaxUpload   int64         `yaml:"max_upload" flag:"max-upload" env:"MAX_UPLOAD_BYTES"`
+	UploadTypes string        `yaml:"upload_types" flag:"upload-types" env:"UPLOAD_TYPES"`
+	UploadTTL   time.Duration `yaml:"upload_ttl" flag:"upload-ttl"`
+
+	WebhookURL     string `yaml:"webhook_url" flag:"webhook-url" env:"WEBHOOK_URL"`
+	WebhookRetries int    `yaml:"webhook_retries" flag:"webhook-retries" env:"WEBHOOK_RETRIES"`
+
+	Tracing      bool   `yaml:"tracing" flag:"tracing" env:"TRACING"`
+	OTLPEndpoint string `yaml:"otlp_endpoint" flag:"otlp-endpoint"`
+
+	BasicAuthUser     string `yaml:"basic_auth_user" env:"BASIC_AUTH_USER"`
+	BasicAuthPassword string `yaml:"basic_auth_password" env:"BASIC_AUTH_PASSWORD"`
+	APIKey            string `yaml:"api_key" env:"API_KEY"`
+	JWTAlg            string `yaml:"jwt_alg" env:"JWT_ALG"`
+	JWTSecret         string `yaml:"jwt_secret" env:"JWT_SECRET"`
+	JWTPublicKeyFile  string `yaml:"jwt_public_key_file" env:"JWT_PUBLIC_KEY_FILE"`
+	SigningSecret     string `yaml:"signing_secret" env:"SIGNING_SECRET"`
+}
+
+// load fills in the settings path sets, leaving alone the ones that were
+// given as a flag, the names in setFlags, or an environment variable.
+// Keys that aren't settings are an error, a typo shouldn't quietly leave
+// something at its default.
+func (c *Config) load(path string, setFlags map[string]bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Decoding into a map as well tells us which keys the file has, so a
+	// false or a 0 in it still counts
+	var keys map[string]any
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var file Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	dst, src := reflect.ValueOf(c).Elem(), reflect.ValueOf(file)
+	t := dst.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if _, ok := keys[f.Tag.Get("yaml")]; !ok {
+			continue
+		}
+		if name := f.Tag.Get("flag"); name != "" && setFlags[name] {
+			continue
+		}
+		if env := f.Tag.Get("env"); env != "" {
+			if _, ok := os.LookupEnv(env); ok {
+				continue
+			}
+		}
+		dst.Field(i).Set(src.Field(i))
+	}
+	return nil
+}
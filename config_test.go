@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigLoad(t *testing.T) {
+	path := writeConfig(t, `
+addr: ":9090"
+store: memory
+count_views: false
+max_body: 2048
+read_timeout: 1m
+tenants: acme
+api_key: from-file
+jwt_secret: from-file
+`)
+	t.Setenv("TENANTS", "globex")
+	t.Setenv("JWT_SECRET", "from-env")
+
+	cfg := Config{Addr: ":8080", Store: "sqlite", CountViews: true, MaxBody: 1 << 20, ReadTimeout: 30 * time.Second, Tenants: "globex", JWTSecret: "from-env", LogFormat: "text"}
+	// -store was given on the command line
+	if err := cfg.load(path, map[string]bool{"store": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := cfg
+	want.Addr, want.CountViews, want.MaxBody, want.ReadTimeout, want.APIKey = ":9090", false, 2048, time.Minute, "from-file"
+	if cfg != want {
+		t.Errorf("loaded\n%+v\nwant\n%+v", cfg, want)
+	}
+	if cfg.Store != "sqlite" || cfg.Tenants != "globex" || cfg.JWTSecret != "from-env" {
+		t.Errorf("flags and environment didn't win over the file: %+v", cfg)
+	}
+	if cfg.LogFormat != "text" {
+		t.Errorf("log_format not in the file reset to %q", cfg.LogFormat)
+	}
+}
+
+func TestConfigLoadErrors(t *testing.T) {
+	var cfg Config
+	if err := cfg.load(writeConfig(t, "adr: \":9090\"\n"), nil); err == nil || !strings.Contains(err.Error(), "adr") {
+		t.Errorf("unknown key = %v, want an error naming it", err)
+	}
+	if err := cfg.load(writeConfig(t, "max_body: lots\n"), nil); err == nil {
+		t.Error("max_body that isn't a number was accepted")
+	}
+	if err := cfg.load(filepath.Join(t.TempDir(), "missing.yaml"), nil); !os.IsNotExist(err) {
+		t.Errorf("missing file = %v", err)
+	}
+}
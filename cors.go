@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Content-Type, Content-Range, X-Upload-Content-Type, Authorization, X-API-Key, X-Request-ID, X-Tenant-ID, X-Signature, Idempotency-Key, If-Match, If-None-Match"
+	corsExposeHeaders = "X-Request-ID, X-Total-Count, Link, Location, ETag, Idempotent-Replayed, Upload-Offset"
+)
+
+// withCORS adds CORS headers for requests coming from one of the allowed
+// origins and answers preflight requests itself. A "*" entry allows any
+// origin. With no allowed origins it does nothing, so browsers keep
+// enforcing the same-origin policy.
+func withCORS(allowed []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || len(allowed) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			if !slices.Contains(allowed, "*") && !slices.Contains(allowed, origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+				h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				h.Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// splitList parses a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
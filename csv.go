@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvHeader is the columns of GET /posts.csv, in order. Tags share one
+// column, separated by commas.
+var csvHeader = []string{"id", "title", "slug", "body", "author", "owner", "tags", "views", "likes", "created_at", "updated_at", "expires_at"}
+
+// handleExportCSV sends every post the caller can read as CSV, for people
+// who'd rather look at them in a spreadsheet than parse JSON. It's the
+// same consistent snapshot a backup gets, soft deleted posts are left out
+// like they are from GET /posts.
+func (s *server) handleExportCSV(w http.ResponseWriter, r *http.Request) {
+	ps, err := s.snapshot(r.Context())
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="posts.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, p := range ps {
+		if p.Deleted || !s.canRead(r.Context(), p) {
+			continue
+		}
+		if err := cw.Write(csvRecord(p)); err != nil {
+			// The client went away
+			return
+		}
+	}
+	cw.Flush()
+}
+
+// CSVImportResult is what POST /posts/import answers with.
+type CSVImportResult struct {
+	Imported int             `json:"imported"`
+	Posts    []Post          `json:"posts"`
+	Skipped  []CSVSkippedRow `json:"skipped"`
+}
+
+// CSVSkippedRow is a row of an import that wasn't a valid post. Line is
+// where it starts in the file, the header being line 1.
+type CSVSkippedRow struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// handleImportCSV creates a post from each row of a text/csv body. The
+// header row names the columns, in the same terms as GET /posts.csv:
+// title and body are required, author, tags and expires_at are taken if
+// present and the rest, the ID included, is the server's to assign. A
+// row that isn't a valid post is skipped and reported, everything else
+// goes in with one CreateMany. CSV that doesn't parse is rejected before
+// anything is created.
+func (s *server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
+	if contentType(r) != "text/csv" {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_content_type", "Request body must be text/csv")
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	cr := csv.NewReader(bytes.NewReader(body))
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = errors.New("no header row")
+		}
+		writeError(w, http.StatusBadRequest, "invalid_csv", "Error parsing CSV: "+err.Error())
+		return
+	}
+	col := make(map[string]int, len(header))
+	for i, name := range header {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"title", "body"} {
+		if _, ok := col[name]; !ok {
+			writeError(w, http.StatusBadRequest, "invalid_csv", "CSV has no "+name+" column")
+			return
+		}
+	}
+	field := func(rec []string, name string) string {
+		if i, ok := col[name]; ok {
+			return rec[i]
+		}
+		return ""
+	}
+
+	result := CSVImportResult{Posts: []Post{}, Skipped: []CSVSkippedRow{}}
+	var ps []Post
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_csv", "Error parsing CSV: "+err.Error())
+			return
+		}
+		line, _ := cr.FieldPos(0)
+
+		p := Post{Title: field(rec, "title"), Body: field(rec, "body"), Author: field(rec, "author")}
+		if tags := field(rec, "tags"); tags != "" {
+			p.Tags = strings.Split(tags, ",")
+		}
+		if v := field(rec, "expires_at"); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				result.Skipped = append(result.Skipped, CSVSkippedRow{line, "expires_at isn't an RFC 3339 time"})
+				continue
+			}
+			p.ExpiresAt = &t
+		}
+		if err := validatePost(p); err != nil {
+			result.Skipped = append(result.Skipped, CSVSkippedRow{line, err.Error()})
+			continue
+		}
+		ps = append(ps, withAuthor(r, p))
+	}
+
+	if len(ps) > 0 {
+		created, evicted, err := s.store.CreateMany(r.Context(), ps)
+		if err != nil {
+			handleStoreError(w, err)
+			return
+		}
+		s.postsEvicted(r, evicted)
+		for _, p := range created {
+			s.recordAudit(r, "create", p.ID)
+			s.publishPost(r, "created", p)
+			s.notifyCreated(r, p)
+		}
+		result.Posts, result.Imported = created, len(created)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+func csvRecord(p Post) []string {
+	expires := ""
+	if p.ExpiresAt != nil {
+		expires = p.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	return []string{
+		p.ID, p.Title, p.Slug, p.Body, p.Author, p.Owner,
+		strings.Join(p.Tags, ","),
+		strconv.FormatInt(p.Views, 10),
+		strconv.FormatInt(p.Likes, 10),
+		p.CreatedAt.Format(time.RFC3339Nano),
+		p.UpdatedAt.Format(time.RFC3339Nano),
+		expires,
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportCSV(t *testing.T) {
+	h := newTestServer(t)
+	p := decode[Post](t, do(h, "POST", "/posts", `{"title":"Quotes, \"and\" commas","body":"line one\nline two","tags":["go","video"]}`))
+	gone := createPost(t, h, "Deleted")
+	do(h, "DELETE", "/post/"+gone.ID, "")
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	do(h, "POST", "/posts", `{"title":"Expired","body":"x","expires_at":"`+past+`"}`)
+
+	rec := do(h, "GET", "/posts.csv", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("GET /posts.csv = %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(strings.NewReader(rec.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatalf("parsing %q: %v", rec.Body, err)
+	}
+	// Deleted and expired posts are left out like they are from GET /posts
+	if len(records) != 2 || !slices.Equal(records[0], csvHeader) {
+		t.Fatalf("exported %q, want the header and one post", records)
+	}
+	got := records[1]
+	if got[0] != p.ID || got[1] != p.Title || got[3] != p.Body || got[6] != "go,video" || got[11] != "" {
+		t.Errorf("exported %q for %+v", got, p)
+	}
+	if created, err := time.Parse(time.RFC3339Nano, got[9]); err != nil || !created.Equal(p.CreatedAt) {
+		t.Errorf("created_at %q, want %v", got[9], p.CreatedAt)
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	h := asSubject("ann", newTestServer(t))
+	importCSV := func(body string) *httptest.ResponseRecorder {
+		return do(h, "POST", "/posts/import", body, "Content-Type", "text/csv")
+	}
+
+	// Columns come in any order, the ones the server assigns are ignored
+	rec := importCSV("id,Body,title,tags,expires_at\n" +
+		"x1,\"spans\ntwo lines\",First,\"go,video\",\n" +
+		"x2,no title,,,\n" +
+		"x3,bad time,Third,,tomorrow\n" +
+		"x4,fine,Fourth,,2099-01-02T03:04:05Z\n")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import = %d %s", rec.Code, rec.Body)
+	}
+	res := decode[CSVImportResult](t, rec)
+	if res.Imported != 2 || len(res.Posts) != 2 {
+		t.Fatalf("imported %+v, want First and Fourth", res)
+	}
+	first := res.Posts[0]
+	if first.ID == "x1" || first.Title != "First" || first.Body != "spans\ntwo lines" || !slices.Equal(first.Tags, []string{"go", "video"}) || first.Owner != "ann" {
+		t.Errorf("imported %+v", first)
+	}
+	if p := res.Posts[1]; p.ExpiresAt == nil || p.ExpiresAt.Year() != 2099 {
+		t.Errorf("expires_at of %+v, want 2099", p)
+	}
+	// Line numbers count the header and the line break inside a field
+	var lines []int
+	for _, s := range res.Skipped {
+		lines = append(lines, s.Line)
+	}
+	if !slices.Equal(lines, []int{4, 5}) {
+		t.Errorf("skipped %+v, want lines 4 and 5", res.Skipped)
+	}
+	if rec := do(h, "GET", "/post/"+first.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("GET imported post = %d", rec.Code)
+	}
+
+	// What the export writes imports back
+	export := do(h, "GET", "/posts.csv", "").Body.String()
+	if res := decode[CSVImportResult](t, importCSV(export)); res.Imported != 2 || len(res.Skipped) != 0 {
+		t.Errorf("importing the export = %+v", res)
+	}
+
+	for _, tc := range []struct {
+		name, contentType, body string
+		want                    int
+	}{
+		{"not CSV", "application/json", `[{"title":"T","body":"x"}]`, http.StatusUnsupportedMediaType},
+		{"empty", "text/csv", "", http.StatusBadRequest},
+		{"no body column", "text/csv", "title\nT\n", http.StatusBadRequest},
+		{"bad quoting", "text/csv", "title,body\nOK,fine\n\"open,x\n", http.StatusBadRequest},
+	} {
+		if rec := do(h, "POST", "/posts/import", tc.body, "Content-Type", tc.contentType); rec.Code != tc.want {
+			t.Errorf("%s: import = %d %s, want %d", tc.name, rec.Code, rec.Body, tc.want)
+		}
+	}
+	// A file that doesn't parse creates nothing, not even its good rows
+	if n := decode[map[string]int](t, do(h, "GET", "/posts/count", ""))["count"]; n != 4 {
+		t.Errorf("%d posts after the failed imports, want 4", n)
+	}
+}
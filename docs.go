@@ -0,0 +1,25 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// docsPage is Swagger UI pointed at our own spec. The UI's scripts and
+// styles are compiled in too, so /docs works without reaching a CDN.
+//
+//go:embed docs.html
+var docsPage []byte
+
+// docs registers GET /docs on mux, with the Swagger UI assets below it.
+func docs(mux *http.ServeMux) {
+	page := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(docsPage)
+	}
+	mux.HandleFunc("GET /docs", page)
+	mux.HandleFunc("GET /docs/{$}", page)
+	mux.Handle("GET /docs/", http.StripPrefix("/docs/", http.FileServerFS(swaggerFiles.FS)))
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDocs(t *testing.T) {
+	mux := http.NewServeMux()
+	docs(mux)
+
+	rec := do(mux, "GET", "/docs", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `url: "/openapi.json"`) {
+		t.Fatalf("GET /docs = %d %s", rec.Code, rec.Body)
+	}
+	// Every asset the page loads is compiled in
+	for _, asset := range []string{"/docs/swagger-ui.css", "/docs/swagger-ui-bundle.js", "/docs/favicon-32x32.png"} {
+		if rec := do(mux, "GET", asset, ""); rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", asset, rec.Code)
+		}
+	}
+}
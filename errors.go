@@ -0,0 +1,35 @@
+package main
+
+import "net/http"
+
+// APIError is the body of every error response, wrapped in an "error"
+// object. Code is a short machine readable string clients can switch on,
+// Message is for humans and may change.
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Field names the offending field for validation errors
+	Field string `json:"field,omitempty"`
+	// Index is the position of the offending entry in a bulk request
+	Index *int `json:"index,omitempty"`
+	// Details lists every broken rule when a post fails validation
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// FieldError is one field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// writeError sends a {"error":{"code":...,"message":...}} response.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeAPIError(w, status, APIError{Code: code, Message: message})
+}
+
+// writeAPIError is writeError for when there's more to say than a code
+// and a message.
+func writeAPIError(w http.ResponseWriter, status int, e APIError) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, map[string]APIError{"error": e})
+}
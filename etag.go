@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrPreconditionFailed is returned when a request's If-Match header doesn't
+// match the post it's trying to change.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// postETag returns a strong ETag for p. It's a hash of the post's JSON, so
+// it changes whenever any field does, UpdatedAt included. The view count
+// is left out, otherwise every read would change it and If-None-Match
+// and If-Match would never match.
+func postETag(p Post) string {
+	p.Views = 0
+	b, _ := json.Marshal(p)
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header value
+// matches etag. The header may be "*" or a comma separated list of tags.
+// Weak tags are compared by their value alone, which is what
+// If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch returns ErrPreconditionFailed when r has an If-Match header
+// that doesn't match p's current ETag. It's meant to be called from inside
+// Store.Update or Store.Delete so the check and the write happen
+// atomically. If-Match uses strong comparison, so weak tags never match.
+func checkIfMatch(r *http.Request, p Post) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+
+	etag := postETag(p)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventsKeepAlive is how often GET /posts/events sends a comment when
+// nothing has happened, so proxies don't take the stream for a dead
+// connection.
+const eventsKeepAlive = 15 * time.Second
+
+// PostEvent is a change to a post. Type is created, updated, restored or
+// deleted, which come with the post's ID, and all but deleted with the
+// post as it is now. A reset event means posts were replaced wholesale,
+// by DELETE /posts or an admin restore, and a client should reload.
+type PostEvent struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	Post *Post  `json:"post,omitempty"`
+
+	// Who gets to see the event, see eventVisible
+	tenant string
+	owner  string
+}
+
+// broadcaster hands every event published to it to each subscriber.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan PostEvent]struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subs: make(map[chan PostEvent]struct{})}
+}
+
+func (b *broadcaster) subscribe() chan PostEvent {
+	ch := make(chan PostEvent, 16)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// unsubscribe stops sending to ch and closes it, unless publish already
+// did.
+func (b *broadcaster) unsubscribe(ch chan PostEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[ch]; ok {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// close ends every subscription, streams included, so shutdown doesn't
+// wait on them.
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// publish never blocks the handler that made the change. A subscriber
+// that has fallen so far behind its channel is full gets cut off instead,
+// quietly skipping events would leave it showing stale posts.
+func (b *broadcaster) publish(e PostEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishPost tells subscribers r did typ to p.
+func (s *server) publishPost(r *http.Request, typ string, p Post) {
+	e := PostEvent{Type: typ, ID: p.ID, tenant: tenantFrom(r.Context()), owner: p.Owner}
+	if typ != "deleted" {
+		e.Post = &p
+	}
+	s.events.publish(e)
+}
+
+// publishReset tells subscribers everything in r's tenant may have
+// changed.
+func (s *server) publishReset(r *http.Request) {
+	s.events.publish(PostEvent{Type: "reset", tenant: tenantFrom(r.Context())})
+}
+
+// eventVisible reports whether r gets to hear about e, which is the case
+// for events in its own tenant about posts it could read.
+func (s *server) eventVisible(r *http.Request, e PostEvent) bool {
+	if e.tenant != tenantFrom(r.Context()) {
+		return false
+	}
+	return e.Type == "reset" || s.canRead(r.Context(), Post{Owner: e.owner})
+}
+
+// handlePostEvents streams changes to posts as Server-Sent Events until
+// the client goes away. Each event's name is its type and its data the
+// PostEvent as JSON.
+func (s *server) handlePostEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream is meant to stay open far longer than -write-timeout
+	rc.SetWriteDeadline(time.Time{})
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Println("error starting event stream:", err)
+		return
+	}
+	releaseSlot(r)
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			if !ok {
+				// Too slow to keep up or we're shutting down, either
+				// way the client can reconnect
+				return
+			}
+			if !s.eventVisible(r, e) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logger.Println("error encoding event:", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPostEvents(t *testing.T) {
+	sem := make(chan struct{}, 1)
+	h := withConcurrencyLimit(sem)(newTestServer(t))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/posts/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	// The stream gave its slot back, or this would be a 503
+	p := createPost(t, h, "Streamed")
+	do(h, "DELETE", "/post/"+p.ID, "")
+
+	sc := bufio.NewScanner(resp.Body)
+	var events []string
+	for len(events) < 2 && sc.Scan() {
+		if name, ok := strings.CutPrefix(sc.Text(), "event: "); ok {
+			events = append(events, name)
+		} else if data, ok := strings.CutPrefix(sc.Text(), "data: "); ok && !strings.Contains(data, p.ID) {
+			t.Errorf("event data %s isn't about %s", data, p.ID)
+		}
+	}
+	if strings.Join(events, ",") != "created,deleted" {
+		t.Errorf("events = %v, want created then deleted", events)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// sweepExpired removes expired posts every interval until stop is called,
+// going through the default tenant and then each of tenants. Reads
+// already hide expired posts, the sweep is what actually frees them. stop
+// waits for a sweep that's under way, so the store can be closed right
+// after.
+func (s *server) sweepExpired(tenants []string, every time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tick := time.NewTicker(every)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				for _, t := range append([]string{""}, tenants...) {
+					s.sweepTenant(context.WithValue(ctx, tenantKey, t))
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// sweepTenant removes the expired posts of the tenant in ctx.
+func (s *server) sweepTenant(ctx context.Context) {
+	expired, err := s.store.DeleteExpired(ctx, time.Now())
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Printf("error removing expired posts of tenant %q: %v", tenantFrom(ctx), err)
+		}
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+	s.recordServerAudit(ctx, "expire", postIDs(expired)...)
+	s.postsRemoved(ctx, expired)
+	logger.Printf("removed %d expired posts", len(expired))
+}
+
+// postsRemoved cleans up after posts the store dropped for good without a
+// client asking, by expiring or being evicted: their files go, and
+// subscribers hear they were deleted. The audit entry is up to the
+// caller, it knows why they went.
+func (s *server) postsRemoved(ctx context.Context, ps []Post) {
+	s.deleteAttachments(ctx, ps, nil)
+	for _, p := range ps {
+		s.events.publish(PostEvent{Type: "deleted", ID: p.ID, tenant: tenantFrom(ctx), owner: p.Owner})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	var srv *server
+	h, dir := newUploadServer(t, func(s *server) { srv, s.audit = s, a })
+
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	body, ct := multipartPost(t, `{"title":"Clip","body":"x","expires_at":"`+past+`"}`, "video/webm", webm)
+	rec := do(h, "POST", "/posts", body, "Content-Type", ct)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload = %d %s", rec.Code, rec.Body)
+	}
+	p := decode[Post](t, rec)
+	kept := createPost(t, h, "Kept")
+
+	// Before the sweep gets to it an expired post is already gone, for
+	// writes as much as for reads
+	for _, tc := range []struct{ method, path, contentType, body string }{
+		{"GET", "/post/" + p.ID, "", ""},
+		{"PUT", "/post/" + p.ID, "application/json", `{"title":"T","body":"back"}`},
+		{"PATCH", "/post/" + p.ID, "application/json", `{"body":"back"}`},
+		{"PATCH", "/post/" + p.ID, mergePatchType, `{"expires_at":null}`},
+		{"PATCH", "/post/" + p.ID, jsonPatchType, `[{"op":"replace","path":"/body","value":"back"}]`},
+		{"DELETE", "/post/" + p.ID, "", ""},
+	} {
+		if rec := do(h, tc.method, tc.path, tc.body, "Content-Type", tc.contentType); rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s (%s) of expired post = %d %s, want 404", tc.method, tc.path, tc.contentType, rec.Code, rec.Body)
+		}
+	}
+
+	srv.sweepTenant(context.Background())
+	if _, err := srv.store.Get(context.Background(), p.ID); err == nil {
+		t.Error("sweep kept the expired post")
+	}
+	if _, err := srv.store.Get(context.Background(), kept.ID); err != nil {
+		t.Errorf("sweep removed a post without expires_at: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, p.Attachment.Path)); !os.IsNotExist(err) {
+		t.Errorf("sweep left the file behind: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var expired []auditEvent
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e auditEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("audit line %q: %v", sc.Text(), err)
+		}
+		if e.Action == "expire" {
+			expired = append(expired, e)
+		}
+	}
+	if len(expired) != 1 || expired[0].PostID != p.ID || expired[0].Method != "" {
+		t.Errorf("audited expiry %+v, want one server event for %s", expired, p.ID)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// postFields is the set of JSON field names a Post has, worked out from
+// its struct tags so new fields can be selected without touching this.
+var postFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeFor[Post]()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// parseFields reads the ?fields= parameter, a comma separated list of the
+// post fields a read should return. No list means every field. Unknown
+// names are an error rather than silently dropped, and so is asking for
+// fields on an XML response since only JSON gets trimmed down.
+func parseFields(r *http.Request, format string) ([]string, error) {
+	fields := splitList(r.URL.Query().Get("fields"))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if format != formatJSON {
+		return nil, errors.New("fields is only supported for JSON responses")
+	}
+	for _, f := range fields {
+		if !postFields[f] {
+			return nil, errors.New("unknown field " + f)
+		}
+	}
+	return fields, nil
+}
+
+// selectFields returns p with only the given fields, or p itself when
+// fields is empty.
+func selectFields(p Post, fields []string) any {
+	if len(fields) == 0 {
+		return p
+	}
+
+	// Going through JSON means the output matches the full post exactly,
+	// omitempty and all
+	data, _ := json.Marshal(p)
+	var all map[string]any
+	json.Unmarshal(data, &all)
+
+	out := make(map[string]any, len(fields))
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			out[f] = v
+		}
+	}
+	return out
+}
+
+// selectFieldsAll is selectFields for a list of posts.
+func selectFieldsAll(ps []Post, fields []string) any {
+	if len(fields) == 0 {
+		return ps
+	}
+	out := make([]any, len(ps))
+	for i, p := range ps {
+		out[i] = selectFields(p, fields)
+	}
+	return out
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipMinSize is the smallest response body worth compressing. Below this
+// the gzip header and footer eat most of the savings.
+const gzipMinSize = 1024
+
+// withGzip compresses response bodies for clients that advertise gzip in
+// Accept-Encoding. Output is buffered until gzipMinSize bytes have been
+// written, so tiny responses go out as they are.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// withGzipBody decodes gzip request bodies, so handlers always read plain
+// JSON. It runs before withMaxBody, which makes the size limit apply to the
+// decoded body and keeps a small gzip bomb from blowing up in memory.
+// Bodies in an encoding we don't know get a 415.
+func withGzipBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "", "identity":
+			next.ServeHTTP(w, r)
+			return
+		case "gzip", "x-gzip":
+		default:
+			w.Header().Set("Accept-Encoding", "gzip")
+			writeError(w, http.StatusUnsupportedMediaType, "unsupported_encoding", "Request body must be gzip encoded or not encoded at all")
+			return
+		}
+
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_body", "Request body is not valid gzip")
+			return
+		}
+		defer zr.Close()
+
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		r.Body = gzipBody{zr, r.Body}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// gzipBody reads through the gzip reader but closes the original body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b gzipBody) Close() error {
+	return b.body.Close()
+}
+
+// badGzip reports whether a read error came from a corrupt gzip body rather
+// than from the connection.
+func badGzip(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &corrupt)
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.TrimSpace(coding)
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		// "gzip;q=0" means the client explicitly doesn't want it
+		params = strings.TrimSpace(params)
+		if q, ok := strings.CutPrefix(params, "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter holds back the status and the start of the body until
+// it knows whether the body is big enough to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	buf     []byte
+	status  int
+	decided bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.status == 0 {
+		gw.status = code
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	if gw.decided {
+		if gw.gz != nil {
+			return gw.gz.Write(b)
+		}
+		return gw.ResponseWriter.Write(b)
+	}
+
+	gw.buf = append(gw.buf, b...)
+	if len(gw.buf) >= gzipMinSize {
+		if err := gw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide sends the held back headers and buffered bytes, compressed if
+// compress is true and the response is one we're allowed to touch.
+func (gw *gzipResponseWriter) decide(compress bool) error {
+	gw.decided = true
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+
+	// Responses that support ranges go out as they are, so that byte
+	// offsets mean the same thing in every response for the resource
+	h := gw.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Accept-Ranges") != "" || gw.status == http.StatusNoContent || gw.status == http.StatusNotModified {
+		compress = false
+	}
+
+	if compress {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if gw.gz != nil {
+		_, err := gw.gz.Write(buf)
+		return err
+	}
+	_, err := gw.ResponseWriter.Write(buf)
+	return err
+}
+
+// Flush sends whatever has been written so far. Streaming handlers call
+// this before the body is known to be large, so it commits to compressing.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		gw.decide(true)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Close finishes the response. If the handler never wrote enough to be
+// worth compressing the buffered bytes go out uncompressed.
+func (gw *gzipResponseWriter) Close() error {
+	if !gw.decided {
+		if gw.status == 0 {
+			// Nothing was written at all, let net/http send its default
+			return nil
+		}
+		return gw.decide(false)
+	}
+	if gw.gz != nil {
+		return gw.gz.Close()
+	}
+	return nil
+}
+
+// Hijack is for WebSockets, which never have a body to compress.
+func (gw *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(gw.ResponseWriter).Hijack()
+}
+
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	h := Chain(newTestServer(t), withGzipBody, withMaxBody(256, 256))
+	post := func(body []byte, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/posts", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(gzipped(t, `{"title":"T","body":"zipped"}`), "gzip")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("gzip POST = %d %s", rec.Code, rec.Body)
+	}
+	if p := decode[Post](t, rec); p.Body != "zipped" {
+		t.Errorf("body = %q, want it decoded", p.Body)
+	}
+
+	if rec := post([]byte("not gzip at all"), "gzip"); rec.Code != http.StatusBadRequest {
+		t.Errorf("garbage gzip = %d, want 400", rec.Code)
+	}
+	truncated := gzipped(t, `{"title":"T","body":"cut short"}`)
+	if rec := post(truncated[:len(truncated)-6], "gzip"); rec.Code != http.StatusBadRequest {
+		t.Errorf("truncated gzip = %d, want 400", rec.Code)
+	}
+
+	rec = post([]byte(`{}`), "br")
+	if rec.Code != http.StatusUnsupportedMediaType || rec.Header().Get("Accept-Encoding") != "gzip" {
+		t.Errorf("brotli body = %d, Accept-Encoding %q", rec.Code, rec.Header().Get("Accept-Encoding"))
+	}
+
+	// The limit counts decoded bytes, so a small bomb still gets a 413
+	bomb := gzipped(t, `{"title":"T","body":"`+strings.Repeat("a", 10000)+`"}`)
+	if len(bomb) > 256 {
+		t.Fatalf("compressed bomb is %d bytes, too big for the test", len(bomb))
+	}
+	if rec := post(bomb, "gzip"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("gzip bomb = %d, want 413", rec.Code)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// idempotencySweep is how often expired idempotency keys are looked for.
+const idempotencySweep = time.Minute
+
+var (
+	errIdempotencyInProgress = errors.New("a request with this idempotency key is still in progress")
+	errIdempotencyMismatch   = errors.New("idempotency key was already used with a different request body")
+)
+
+// idempotencyKeys remembers which post each Idempotency-Key created, so a
+// retried create gets the original post back instead of making another
+// one. Keys are forgotten after ttl to keep the map bounded.
+type idempotencyKeys struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	ttl     time.Duration
+}
+
+type idempotencyEntry struct {
+	// bodyHash catches a key being reused for a different request
+	bodyHash [32]byte
+	// post is nil while the first request is still being handled
+	post    *Post
+	expires time.Time
+}
+
+func newIdempotencyKeys(ttl time.Duration) *idempotencyKeys {
+	k := &idempotencyKeys{
+		entries: make(map[string]*idempotencyEntry),
+		ttl:     ttl,
+	}
+	go k.sweep()
+	return k
+}
+
+// begin claims key for a request with the given body hash. If the key
+// has already created a post that post is returned and the caller should
+// replay it. Otherwise the caller owns the key and must call finish or
+// abort once it knows how the create went.
+func (k *idempotencyKeys) begin(key string, bodyHash [32]byte) (*Post, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if e, ok := k.entries[key]; ok && time.Now().Before(e.expires) {
+		if e.bodyHash != bodyHash {
+			return nil, errIdempotencyMismatch
+		}
+		if e.post == nil {
+			return nil, errIdempotencyInProgress
+		}
+		return e.post, nil
+	}
+
+	k.entries[key] = &idempotencyEntry{bodyHash: bodyHash, expires: time.Now().Add(k.ttl)}
+	return nil, nil
+}
+
+// finish records the post created under key.
+func (k *idempotencyKeys) finish(key string, p Post) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if e, ok := k.entries[key]; ok {
+		e.post = &p
+	}
+}
+
+// abort releases key after a failed create so the client can retry it.
+func (k *idempotencyKeys) abort(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	delete(k.entries, key)
+}
+
+func (k *idempotencyKeys) sweep() {
+	for range time.Tick(idempotencySweep) {
+		k.mu.Lock()
+		now := time.Now()
+		for key, e := range k.entries {
+			if now.After(e.expires) {
+				delete(k.entries, key)
+			}
+		}
+		k.mu.Unlock()
+	}
+}
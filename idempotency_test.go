@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	k := newIdempotencyKeys(time.Hour)
+	body := sha256.Sum256([]byte("body"))
+
+	if prev, err := k.begin("a", body); prev != nil || err != nil {
+		t.Fatalf("first begin = %v, %v", prev, err)
+	}
+	if _, err := k.begin("a", body); !errors.Is(err, errIdempotencyInProgress) {
+		t.Errorf("begin while in progress = %v, want errIdempotencyInProgress", err)
+	}
+	k.finish("a", Post{ID: "created"})
+	if prev, err := k.begin("a", body); err != nil || prev == nil || prev.ID != "created" {
+		t.Errorf("begin after finish = %v, %v, want the created post", prev, err)
+	}
+	if _, err := k.begin("a", sha256.Sum256([]byte("other"))); !errors.Is(err, errIdempotencyMismatch) {
+		t.Errorf("begin with another body = %v, want errIdempotencyMismatch", err)
+	}
+
+	// An aborted create can be retried under the same key
+	k.begin("b", body)
+	k.abort("b")
+	if prev, err := k.begin("b", body); prev != nil || err != nil {
+		t.Errorf("begin after abort = %v, %v", prev, err)
+	}
+
+	// Expired keys are free again even before the sweep gets to them
+	k = newIdempotencyKeys(time.Nanosecond)
+	k.begin("c", body)
+	k.finish("c", Post{ID: "old"})
+	time.Sleep(time.Millisecond)
+	if prev, err := k.begin("c", sha256.Sum256([]byte("other"))); prev != nil || err != nil {
+		t.Errorf("begin after expiry = %v, %v", prev, err)
+	}
+}
+
+func TestIdempotentCreate(t *testing.T) {
+	h := newTestServer(t, func(s *server) { s.idempotency = newIdempotencyKeys(time.Hour) })
+	key := []string{"Idempotency-Key", "retry-me"}
+
+	first := do(h, "POST", "/posts", `{"title":"T","body":"once"}`, key...)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first POST = %d %s", first.Code, first.Body)
+	}
+	retry := do(h, "POST", "/posts", `{"title":"T","body":"once"}`, key...)
+	if retry.Code != http.StatusCreated || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retried POST = %d, replayed %q", retry.Code, retry.Header().Get("Idempotent-Replayed"))
+	}
+	if a, b := decode[Post](t, first), decode[Post](t, retry); a.ID != b.ID {
+		t.Errorf("retry created %s, first request %s", b.ID, a.ID)
+	}
+
+	if rec := do(h, "POST", "/posts", `{"title":"T","body":"twice"}`, key...); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST reusing the key with another body = %d, want 422", rec.Code)
+	}
+	if n := len(decode[[]Post](t, do(h, "GET", "/posts", ""))); n != 1 {
+		t.Errorf("%d posts after retries, want 1", n)
+	}
+}
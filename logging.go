@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// logFormat selects how logRequest writes access log lines, either "text"
+// or "json".
+var logFormat = "text"
+
+const accessLogKey contextKey = "access_log"
+
+// accessLogEntry is a single line of the JSON access log. The response
+// fields are only there once withAccessLog logs the finished request.
+type accessLogEntry struct {
+	Time          string `json:"time"`
+	RequestID     string `json:"request_id,omitempty"`
+	Subject       string `json:"subject,omitempty"`
+	Handler       string `json:"handler"`
+	Method        string `json:"method"`
+	Path          string `json:"path"`
+	ContentLength int64  `json:"content_length"`
+
+	Status     int     `json:"status,omitempty"`
+	Bytes      int     `json:"bytes,omitempty"`
+	DurationMS float64 `json:"duration_ms,omitempty"`
+}
+
+func loggerSetup() *log.Logger {
+	logger := log.Default()
+	logger.SetFlags(log.LstdFlags | log.Lshortfile)
+	return logger
+}
+
+// logRequest logs a request as its handler starts on it. Under
+// withAccessLog it only notes the handler and who's asking, and the line
+// is written once the response is done instead.
+func logRequest(handler string, r *http.Request) {
+	e := accessLogEntry{
+		RequestID:     requestIDFrom(r.Context()),
+		Subject:       subjectFrom(r.Context()),
+		Handler:       handler,
+		Method:        r.Method,
+		Path:          r.RequestURI,
+		ContentLength: r.ContentLength,
+	}
+	if pending, ok := r.Context().Value(accessLogKey).(*accessLogEntry); ok {
+		pending.Handler, pending.Subject = e.Handler, e.Subject
+		return
+	}
+	writeAccessLog(e)
+}
+
+// withAccessLog writes one access log line per request when it finishes,
+// like nginx does, with the status, bytes sent and how long it took.
+// Requests turned away before reaching a handler, by auth or rate
+// limiting for instance, are logged under route.
+func withAccessLog(route string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			e := &accessLogEntry{
+				RequestID:     requestIDFrom(r.Context()),
+				Handler:       route,
+				Method:        r.Method,
+				Path:          r.RequestURI,
+				ContentLength: r.ContentLength,
+			}
+			rec := &statusRecorder{ResponseWriter: w}
+
+			next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessLogKey, e)))
+
+			e.Status, e.Bytes = rec.Status(), rec.bytes
+			e.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+			writeAccessLog(*e)
+		})
+	}
+}
+
+func writeAccessLog(e accessLogEntry) {
+	if logFormat == "json" {
+		e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+		// Written straight to the logger's output so the line isn't
+		// prefixed with the date and file, keeping it valid JSON
+		b, err := json.Marshal(e)
+		if err != nil {
+			logger.Println("error encoding access log:", err)
+			return
+		}
+		logger.Writer().Write(append(b, '\n'))
+		return
+	}
+
+	args := []any{e.Handler, "->", e.Method, e.Path, e.ContentLength}
+	if e.Status != 0 {
+		args = append(args, "->", e.Status, strconv.Itoa(e.Bytes)+"B", strconv.FormatFloat(e.DurationMS, 'f', 2, 64)+"ms")
+	}
+	if e.Subject != "" {
+		args = append(args, "by", e.Subject)
+	}
+	msg := fmt.Sprintln(args...)
+	if e.RequestID != "" {
+		msg = "[" + e.RequestID + "] " + msg
+	}
+	logger.Print(msg)
+}
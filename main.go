@@ -1,160 +1,1318 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
-	"sync"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Post struct {
-	ID   int    `json:"id"`
-	Body string `json:"body"`
+	XMLName xml.Name `json:"-" xml:"post"`
+	ID      string   `json:"id" xml:"id"`
+	Title   string   `json:"title" xml:"title"`
+	Slug    string   `json:"slug,omitempty" xml:"slug,omitempty"`
+	Body    string   `json:"body" xml:"body"`
+	Author  string   `json:"author,omitempty" xml:"author,omitempty"`
+	// Owner is who created the post, see checkOwner
+	Owner     string    `json:"owner,omitempty" xml:"owner,omitempty"`
+	Tags      []string  `json:"tags,omitempty" xml:"tags>tag,omitempty"`
+	Views     int64     `json:"views" xml:"views"`
+	Likes     int64     `json:"likes" xml:"likes"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`
+
+	// Attachment is set by uploading a file, see handleUploadPost
+	Attachment *Attachment `json:"attachment,omitempty" xml:"attachment,omitempty"`
+
+	// Deleted posts are hidden until restored, see handleDeletePost
+	Deleted   bool       `json:"deleted,omitempty" xml:"deleted,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+
+	// ExpiresAt is when the post goes away by itself, nil for never. See
+	// sweepExpired.
+	ExpiresAt *time.Time `json:"expires_at,omitempty" xml:"expires_at,omitempty"`
+}
+
+// PostsPage is the response body for cursor paginated listings.
+// NextCursor is empty once the last page has been reached.
+type PostsPage struct {
+	XMLName    xml.Name `json:"-" xml:"posts"`
+	Posts      []Post   `json:"posts" xml:"post"`
+	NextCursor string   `json:"next_cursor" xml:"next_cursor,attr"`
 }
 
-var (
-	posts   = make(map[int]Post)
-	nextID  = 1
-	postsMu sync.Mutex
-	logger  = loggerSetup()
+// PostPatch holds the fields a PATCH request may change. A nil field
+// means the client didn't send it, so the stored value is left alone.
+type PostPatch struct {
+	Title *string   `json:"title"`
+	Body  *string   `json:"body"`
+	Tags  *[]string `json:"tags"`
+	// ExpiresAt can only be set or moved here, clearing it takes a merge
+	// patch with null
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+const (
+	defaultLimit = 20
+	maxLimit     = 100
+
+	shutdownTimeout = 10 * time.Second
+
+	// maxIdempotencyKey is the longest Idempotency-Key we'll remember
+	maxIdempotencyKey = 255
 )
 
+var logger = loggerSetup()
+
 func main() {
-	http.HandleFunc("/posts", postsHandler)
-	http.HandleFunc("/post/", postHandler)
+	// Secrets only come from the environment or the config file
+	cfg := Config{
+		BasicAuthUser:     os.Getenv("BASIC_AUTH_USER"),
+		BasicAuthPassword: os.Getenv("BASIC_AUTH_PASSWORD"),
+		APIKey:            os.Getenv("API_KEY"),
+		JWTAlg:            envOr("JWT_ALG", "HS256"),
+		JWTSecret:         os.Getenv("JWT_SECRET"),
+		JWTPublicKeyFile:  os.Getenv("JWT_PUBLIC_KEY_FILE"),
+		SigningSecret:     os.Getenv("SIGNING_SECRET"),
+	}
+	configPath := flag.String("config", envOr("CONFIG", ""), "YAML file with settings, flags and environment variables take precedence over it (env CONFIG)")
+	flag.StringVar(&cfg.Addr, "addr", envOr("ADDR", ":8080"), "address to listen on (env ADDR)")
+	flag.StringVar(&cfg.CORSOrigins, "cors-origins", envOr("CORS_ORIGINS", ""), "comma separated origins allowed to make cross-origin requests, * for any (env CORS_ORIGINS)")
+	flag.Float64Var(&cfg.RateLimit, "rate-limit", 0, "requests per second allowed per client IP, 0 disables rate limiting")
+	flag.IntVar(&cfg.RateBurst, "rate-burst", 10, "how many requests a client IP may make in a burst")
+	flag.IntVar(&cfg.MaxConcurrent, "max-concurrent", 0, "most API requests handled at once, more get a 503, 0 means no limit")
+	flag.BoolVar(&cfg.TrustProxy, "trust-proxy", false, "take the client IP from X-Forwarded-For, only enable behind a proxy that sets it")
+	flag.Int64Var(&cfg.MaxBody, "max-body", envOrInt64("MAX_BODY_BYTES", 1<<20), "largest request body accepted, in bytes (env MAX_BODY_BYTES)")
+	flag.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", 5*time.Second, "how long a client may take to send the request headers")
+	flag.DurationVar(&cfg.ReadTimeout, "read-timeout", 30*time.Second, "how long a client may take to send the whole request")
+	flag.DurationVar(&cfg.WriteTimeout, "write-timeout", 30*time.Second, "how long writing the response may take")
+	flag.DurationVar(&cfg.IdleTimeout, "idle-timeout", 2*time.Minute, "how long keep-alive connections are kept open between requests")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", envOr("TLS_CERT_FILE", ""), "TLS certificate file, serves HTTPS together with -tls-key (env TLS_CERT_FILE)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", envOr("TLS_KEY_FILE", ""), "TLS private key file (env TLS_KEY_FILE)")
+	flag.StringVar(&cfg.LogFormat, "log-format", envOr("LOG_FORMAT", "text"), "access log format: text or json (env LOG_FORMAT)")
+	flag.StringVar(&cfg.Store, "store", "sqlite", "where posts are kept: sqlite, json or memory")
+	flag.StringVar(&cfg.Data, "data", "", "path of the store's data file (default posts.db for sqlite, posts.json for json)")
+	flag.IntVar(&cfg.MaxPosts, "max-posts", int(envOrInt64("MAX_POSTS", 0)), "most posts kept, each tenant's counted apart, creating one more evicts the oldest, 0 means no limit (env MAX_POSTS)")
+	flag.DurationVar(&cfg.ExpirySweep, "expiry-sweep", envOrDuration("EXPIRY_SWEEP", time.Minute), "how often posts past their expires_at are removed, 0 leaves them hidden but stored (env EXPIRY_SWEEP)")
+	flag.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", 24*time.Hour, "how long Idempotency-Key headers on creates are remembered, 0 disables them")
+	flag.StringVar(&cfg.Tenants, "tenants", envOr("TENANTS", ""), "comma separated tenant IDs clients can pick with X-Tenant-ID, each gets a store of its own (env TENANTS)")
+	flag.IntVar(&cfg.MaxRevisions, "max-revisions", int(envOrInt64("MAX_REVISIONS", 20)), "earlier versions of each post's body to keep, 0 keeps none (env MAX_REVISIONS)")
+	flag.BoolVar(&cfg.CountViews, "count-views", envOrBool("COUNT_VIEWS", true), "count how often each post is fetched, turn off for benchmarks (env COUNT_VIEWS)")
+	flag.BoolVar(&cfg.AllowDeleteAll, "allow-delete-all", envOrBool("ALLOW_DELETE_ALL", false), "enable DELETE /posts, which wipes every post, for dev and test setups (env ALLOW_DELETE_ALL)")
+	flag.StringVar(&cfg.Storage, "storage", envOr("STORAGE", "disk"), "where uploaded files are kept: disk, or s3 configured with S3_BUCKET, S3_ENDPOINT, S3_REGION and AWS credentials (env STORAGE)")
+	flag.StringVar(&cfg.UploadDir, "upload-dir", envOr("UPLOAD_DIR", "uploads"), "directory unfinished uploads are kept in, and with -storage disk the uploaded files too (env UPLOAD_DIR)")
+	flag.Int64Var(&cfg.MaxUpload, "max-upload", envOrInt64("MAX_UPLOAD_BYTES", 100<<20), "largest file that can be uploaded with a post, in bytes (env MAX_UPLOAD_BYTES)")
+	flag.StringVar(&cfg.UploadTypes, "upload-types", envOr("UPLOAD_TYPES", "image/*,video/*,audio/*,application/pdf"), "comma separated content types that can be uploaded, type/* allows a whole family (env UPLOAD_TYPES)")
+	flag.DurationVar(&cfg.UploadTTL, "upload-ttl", 24*time.Hour, "how long an unfinished resumable upload is kept after its last chunk, 0 keeps them forever")
+	flag.BoolVar(&cfg.Tracing, "tracing", envOrBool("TRACING", false), "export OpenTelemetry traces of every request over OTLP/HTTP (env TRACING)")
+	flag.BoolVar(&cfg.PrivatePosts, "private-posts", envOrBool("PRIVATE_POSTS", false), "only let clients read their own posts and ones without an owner, reads need authentication too (env PRIVATE_POSTS)")
+	flag.BoolVar(&cfg.ReadOnly, "readonly", envOrBool("READONLY", false), "reject every request that would change something with a 503, for maintenance (env READONLY)")
+	flag.StringVar(&cfg.AuditLog, "audit-log", envOr("AUDIT_LOG", ""), "file every create, update and delete of a post is appended to, empty disables the audit log (env AUDIT_LOG)")
+	flag.StringVar(&cfg.WebhookURL, "webhook-url", envOr("WEBHOOK_URL", ""), "URL every new post is POSTed to as JSON, empty disables the webhook (env WEBHOOK_URL)")
+	flag.IntVar(&cfg.WebhookRetries, "webhook-retries", int(envOrInt64("WEBHOOK_RETRIES", 2)), "how often a failed webhook delivery is retried (env WEBHOOK_RETRIES)")
+	flag.StringVar(&cfg.OTLPEndpoint, "otlp-endpoint", "", "URL traces are sent to, like http://localhost:4318 (default from the standard OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.Parse()
+
+	if *configPath != "" {
+		set := make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if err := cfg.load(*configPath, set); err != nil {
+			log.Fatal("error loading config: ", err)
+		}
+	}
+	logFormat = cfg.LogFormat
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+
+	if logFormat != "text" && logFormat != "json" {
+		log.Fatal("unknown log format ", logFormat)
+	}
+
+	tenants := splitList(cfg.Tenants)
+	store, err := openTenantStores(cfg.Store, cfg.Data, cfg.MaxRevisions, cfg.MaxPosts, tenants)
+	if err != nil {
+		log.Fatal("error opening store: ", err)
+	}
+	srv := newServer(store)
+	srv.allowDeleteAll = cfg.AllowDeleteAll
+	srv.privatePosts = cfg.PrivatePosts
+	// Counting a view writes to the store too
+	srv.countViews = cfg.CountViews && !cfg.ReadOnly
+	srv.uploadDir, srv.maxUpload, srv.uploadTypes = cfg.UploadDir, cfg.MaxUpload, splitList(cfg.UploadTypes)
+	if srv.files, err = openStorage(cfg.Storage, cfg.UploadDir); err != nil {
+		log.Fatal("error opening storage: ", err)
+	}
+	if cfg.IdempotencyTTL > 0 {
+		srv.idempotency = newIdempotencyKeys(cfg.IdempotencyTTL)
+	}
+	if cfg.UploadTTL > 0 {
+		go srv.sweepUploads(cfg.UploadTTL)
+	}
+	if cfg.AuditLog != "" {
+		if srv.audit, err = openAuditLog(cfg.AuditLog); err != nil {
+			log.Fatal("error opening audit log: ", err)
+		}
+	}
+	if cfg.WebhookURL != "" {
+		srv.webhook = newWebhook(cfg.WebhookURL, max(cfg.WebhookRetries, 0))
+	}
+
+	var tracer trace.Tracer
+	stopTracing := func(context.Context) error { return nil }
+	if cfg.Tracing {
+		tracer, stopTracing, err = setupTracing(context.Background(), cfg.OTLPEndpoint)
+		if err != nil {
+			log.Fatal("error setting up tracing: ", err)
+		}
+	}
+
+	allowedOrigins := splitList(cfg.CORSOrigins)
+	srv.origins = allowedOrigins
 
-	fmt.Println("Server is running at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	// JWT auth is on as soon as a secret or public key is configured
+	var jwtKey any
+	if cfg.JWTSecret != "" || cfg.JWTPublicKeyFile != "" {
+		jwtKey, err = loadJWTKey(cfg.JWTAlg, cfg.JWTSecret, cfg.JWTPublicKeyFile)
+		if err != nil {
+			log.Fatal("error loading JWT key: ", err)
+		}
+	}
+
+	var limiter *ipRateLimiter
+	if cfg.RateLimit > 0 {
+		limiter = newIPRateLimiter(cfg.RateLimit, cfg.RateBurst, cfg.TrustProxy)
+	}
+	var inFlight chan struct{}
+	if cfg.MaxConcurrent > 0 {
+		inFlight = make(chan struct{}, cfg.MaxConcurrent)
+	}
+
+	// api wraps a posts route with the middleware every API request goes
+	// through, the first one here is the first to see the request.
+	api := func(route string, h http.HandlerFunc) http.Handler {
+		logged := func(w http.ResponseWriter, r *http.Request) {
+			logRequest(route, r)
+			h(w, r)
+		}
+		return Chain(http.HandlerFunc(logged),
+			withRequestID,
+			withMetrics(route),
+			withAccessLog(route),
+			withReadAuth(cfg.PrivatePosts),
+			withTracing(tracer, route),
+			withRateLimit(limiter),
+			withConcurrencyLimit(inFlight),
+			withRecovery,
+			withCORS(allowedOrigins),
+			withReadOnly(cfg.ReadOnly),
+			withTenant(tenants),
+			withGzip,
+			withSignature([]byte(cfg.SigningSecret), cfg.MaxBody),
+			withGzipBody,
+			withMaxBody(cfg.MaxBody, cfg.MaxBody+cfg.MaxUpload),
+			withJWT(cfg.JWTAlg, jwtKey),
+			withAPIKey(cfg.APIKey),
+			withBasicAuth(cfg.BasicAuthUser, cfg.BasicAuthPassword),
+		)
+	}
+
+	apiMux := http.NewServeMux()
+	srv.routes(apiMux, api)
+	http.Handle("/", apiMux)
+	http.Handle("/v1/", versioned("/v1", apiMux))
+	http.HandleFunc("GET /openapi.json", openAPIHandler)
+	docs(http.DefaultServeMux)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", srv.readyzHandler)
+	http.Handle("/metrics", promhttp.Handler())
+
+	// Without timeouts a client can hold a connection open forever by
+	// sending its request a byte at a time
+	server := &http.Server{
+		Addr:              cfg.Addr,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	// Event streams never finish on their own
+	server.RegisterOnShutdown(srv.events.close)
+
+	// The sweep deletes posts, which -readonly promises not to do
+	stopSweep := func() {}
+	if cfg.ExpirySweep > 0 && !cfg.ReadOnly {
+		stopSweep = srv.sweepExpired(tenants, cfg.ExpirySweep)
+	}
+
+	go func() {
+		var err error
+		if cfg.TLSCert != "" {
+			fmt.Println("Server is running at https://" + displayAddr(cfg.Addr) + " (TLS)")
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			fmt.Println("Server is running at http://" + displayAddr(cfg.Addr) + " (plain HTTP)")
+			err = server.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Block until we're asked to stop, then give in-flight requests a
+	// chance to finish before closing the store underneath them
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	logger.Println("Shutting down, draining in-flight requests")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Println("error shutting down server:", err)
+	}
+	if srv.webhook != nil {
+		if err := srv.webhook.wait(ctx); err != nil {
+			logger.Println("error waiting for webhooks:", err)
+		}
+	}
+	stopSweep()
+	if err := store.Close(); err != nil {
+		logger.Println("error closing store:", err)
+	}
+	if srv.audit != nil {
+		if err := srv.audit.Close(); err != nil {
+			logger.Println("error closing audit log:", err)
+		}
+	}
+	if err := stopTracing(ctx); err != nil {
+		logger.Println("error flushing traces:", err)
+	}
+	logger.Println("Server stopped")
 }
 
-func postsHandler(w http.ResponseWriter, r *http.Request) {
-	logRequest("/posts", r)
-	switch r.Method {
-	case "GET":
-		handleGetPosts(w, r)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// envOr returns the environment variable key, or def when it isn't set.
+// Flags use it for their defaults so an explicit flag still wins.
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// envOrInt64 is envOr for integer settings. A value that doesn't parse is
+// ignored in favour of def.
+func envOrInt64(key string, def int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envOrBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
 	}
+	return v
 }
 
-func postHandler(w http.ResponseWriter, r *http.Request) {
-	logRequest("/post/", r)
-	id, err := strconv.Atoi(r.URL.Path[len("/post/"):])
+func envOrDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// displayAddr fills in localhost for listen addresses without a host
+// (like ":8080") so the startup message is a clickable URL.
+func displayAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+func (s *server) handleGetPosts(w http.ResponseWriter, r *http.Request) {
+	format, ok := negotiateFormat(r)
+	if !ok {
+		writeError(w, http.StatusNotAcceptable, "not_acceptable", "Not acceptable, supported types are application/json and application/xml")
+		return
+	}
+
+	fields, err := parseFields(r, format)
 	if err != nil {
-		http.Error(w, "Invalid post ID", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_fields", err.Error())
 		return
 	}
 
-	switch r.Method {
-	case "GET":
-		handleGetPost(w, r, id)
-	case "POST":
-		handlePostPost(w, r, id)
-	case "DELETE":
-		handleDeletePost(w, r, id)
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	all = s.readable(r.Context(), all)
+
+	// ?ids= fetches a known set of posts in one go, in the order asked
+	// for. Filters, sorting and paging don't apply.
+	if r.URL.Query().Has("ids") {
+		ids := splitList(r.URL.Query().Get("ids"))
+		if len(ids) > maxLimit {
+			writeError(w, http.StatusBadRequest, "too_many_ids", "At most "+strconv.Itoa(maxLimit)+" ids can be fetched at once")
+			return
+		}
+		ps := pickPosts(all, ids)
+		if format == formatXML {
+			writeFormatted(w, r, format, http.StatusOK, PostList{Posts: ps})
+			return
+		}
+		writeFormatted(w, r, format, http.StatusOK, selectFieldsAll(ps, fields))
+		return
+	}
+
+	ps, err := filterPosts(r, all)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+
+	// The total is taken after filtering but before paging, so clients can
+	// render page controls without a separate /posts/count call
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(ps)))
+
+	// Stores don't guarantee any order, so sort before slicing to keep
+	// pages stable between requests. By default that's creation order.
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "created_at"
+	}
+	byField, ok := postOrders[sortBy]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid_sort", "Invalid sort field")
+		return
+	}
+
+	desc := false
+	switch r.URL.Query().Get("order") {
+	case "", "asc":
+	case "desc":
+		desc = true
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusBadRequest, "invalid_order", "Invalid sort order")
+		return
+	}
+
+	// Ties are broken by ID so the order is total, which cursor
+	// pagination relies on
+	compare := func(a, b Post) int {
+		c := byField(a, b)
+		if c == 0 {
+			c = strings.Compare(a.ID, b.ID)
+		}
+		if desc {
+			c = -c
+		}
+		return c
+	}
+	slices.SortFunc(ps, compare)
+
+	limit := queryInt(r, "limit", defaultLimit)
+	if limit <= 0 {
+		limit = defaultLimit
 	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	// Passing ?cursor= (even empty, for the first page) switches to
+	// cursor pagination, which doesn't drift when posts are added or
+	// removed between pages
+	if r.URL.Query().Has("cursor") {
+		cursor := r.URL.Query().Get("cursor")
+		start := 0
+		if cursor != "" {
+			after, err := decodeCursor(cursor)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid_cursor", "Invalid cursor")
+				return
+			}
+			start = sort.Search(len(ps), func(i int) bool {
+				return compare(ps[i], after) > 0
+			})
+		}
+		page := PostsPage{Posts: paginate(ps, start, limit)}
+		if start+limit < len(ps) {
+			page.NextCursor = encodeCursor(page.Posts[len(page.Posts)-1])
+		}
+
+		// Cursors only go forwards, so there's no prev or last
+		links := []string{pageLink(r, "first", "cursor", "")}
+		if page.NextCursor != "" {
+			links = append(links, pageLink(r, "next", "cursor", page.NextCursor))
+		}
+		w.Header().Set("Link", strings.Join(links, ", "))
+
+		if fields != nil {
+			writeFormatted(w, r, format, http.StatusOK, map[string]any{
+				"posts":       selectFieldsAll(page.Posts, fields),
+				"next_cursor": page.NextCursor,
+			})
+			return
+		}
+		writeFormatted(w, r, format, http.StatusOK, page)
+		return
+	}
+
+	offset := queryInt(r, "offset", 0)
+	if offset < 0 {
+		offset = 0
+	}
+
+	total := len(ps)
+	links := []string{pageLink(r, "first", "offset", "0")}
+	if offset > 0 {
+		links = append(links, pageLink(r, "prev", "offset", strconv.Itoa(max(offset-limit, 0))))
+	}
+	if offset+limit < total {
+		links = append(links, pageLink(r, "next", "offset", strconv.Itoa(offset+limit)))
+	}
+	if total > 0 {
+		links = append(links, pageLink(r, "last", "offset", strconv.Itoa((total-1)/limit*limit)))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+
+	ps = paginate(ps, offset, limit)
+
+	if format == formatXML {
+		writeFormatted(w, r, format, http.StatusOK, PostList{Posts: ps})
+		return
+	}
+	writeFormatted(w, r, format, http.StatusOK, selectFieldsAll(ps, fields))
 }
 
-func handleGetPosts(w http.ResponseWriter, r *http.Request) {
-	postsMu.Lock()         // lock data context to prevent race conditions
-	defer postsMu.Unlock() // defer unclock until function has finished executing
+// filterPosts returns the posts matching the request's filter parameters:
+// the ?q= search of titles and bodies, ?author=, any number of ?tag=
+// filters and the ?created_after= and ?created_before= RFC 3339 bounds,
+// all of which must match. It's shared by every endpoint that lists or
+// counts posts so they always agree. An error means a parameter couldn't
+// be parsed.
+func filterPosts(r *http.Request, all []Post) ([]Post, error) {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	author := strings.TrimSpace(r.URL.Query().Get("author"))
+	tags := normalizeTags(r.URL.Query()["tag"])
 
-	// Copying the posts to a new slice of type []Post
-	ps := make([]Post, 0, len(posts))
-	for _, p := range posts {
+	after, err := queryTime(r, "created_after")
+	if err != nil {
+		return nil, err
+	}
+	before, err := queryTime(r, "created_before")
+	if err != nil {
+		return nil, err
+	}
+
+	// Copying the posts to a new slice of type []Post, skipping the ones
+	// that don't match the filters
+	ps := make([]Post, 0, len(all))
+	for _, p := range all {
+		if q != "" && !strings.Contains(strings.ToLower(p.Title), q) && !strings.Contains(strings.ToLower(p.Body), q) {
+			continue
+		}
+		if author != "" && p.Author != author {
+			continue
+		}
+		if !hasTags(p, tags) {
+			continue
+		}
+		if !after.IsZero() && !p.CreatedAt.After(after) {
+			continue
+		}
+		if !before.IsZero() && !p.CreatedAt.Before(before) {
+			continue
+		}
 		ps = append(ps, p)
 	}
+	return ps, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ps)
+// queryTime reads an RFC 3339 timestamp query parameter. A missing one is
+// the zero time.
+func queryTime(r *http.Request, name string) (time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, errors.New(name + " must be an RFC 3339 timestamp")
+	}
+	return t, nil
+}
+
+// pageLink builds one entry of an RFC 8288 Link header: the request's own
+// URL with param set to value, and the given rel.
+func pageLink(r *http.Request, rel, param, value string) string {
+	q := r.URL.Query()
+	q.Set(param, value)
+	u := url.URL{Path: apiPrefix(r.Context()) + r.URL.Path, RawQuery: q.Encode()}
+	return "<" + u.String() + `>; rel="` + rel + `"`
+}
+
+// pickPosts returns the posts with the given IDs, in the same order.
+// IDs that don't exist are skipped and repeated ones only count once.
+func pickPosts(all []Post, ids []string) []Post {
+	byID := make(map[string]Post, len(all))
+	for _, p := range all {
+		byID[p.ID] = p
+	}
+
+	ps := []Post{}
+	for _, id := range ids {
+		if p, ok := byID[id]; ok {
+			ps = append(ps, p)
+			delete(byID, id)
+		}
+	}
+	return ps
+}
+
+// hasTags reports whether p is tagged with every one of tags.
+func hasTags(p Post, tags []string) bool {
+	for _, t := range tags {
+		if !slices.Contains(p.Tags, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// postOrders are the fields GET /posts can be sorted by.
+var postOrders = map[string]func(a, b Post) int{
+	"created_at": func(a, b Post) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"id":         func(a, b Post) int { return 0 }, // the ID tie break does it
+}
+
+// pageCursor is what a cursor holds: every field of the last post on a
+// page that pages can be sorted by, so the next page can be found even if
+// that post has since been deleted.
+type pageCursor struct {
+	ID        string    `json:"i"`
+	CreatedAt time.Time `json:"c"`
+}
+
+// encodeCursor turns the last post of a page into an opaque cursor string.
+func encodeCursor(p Post) string {
+	b, _ := json.Marshal(pageCursor{ID: p.ID, CreatedAt: p.CreatedAt})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reverses encodeCursor, giving back a Post with just the
+// sortable fields set.
+func decodeCursor(cursor string) (Post, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return Post{}, err
+	}
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return Post{}, err
+	}
+	return Post{ID: c.ID, CreatedAt: c.CreatedAt}, nil
+}
+
+// paginate returns the window of ps starting at offset with at most
+// limit entries.
+func paginate(ps []Post, offset, limit int) []Post {
+	if offset >= len(ps) {
+		return []Post{}
+	}
+	end := offset + limit
+	if end > len(ps) {
+		end = len(ps)
+	}
+	return ps[offset:end]
 }
 
-func handleGetPost(w http.ResponseWriter, r *http.Request, id int) {
-	postsMu.Lock()
-	defer postsMu.Unlock()
+// queryInt reads an integer query parameter, returning def when it's
+// missing or not a number.
+func queryInt(r *http.Request, name string, def int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil {
+		return def
+	}
+	return v
+}
 
-	p, ok := posts[id]
+func (s *server) handleGetPost(w http.ResponseWriter, r *http.Request, id string) {
+	s.servePost(w, r, func(ctx context.Context) (Post, error) {
+		return s.store.Get(ctx, id)
+	})
+}
+
+func (s *server) handleGetPostBySlug(w http.ResponseWriter, r *http.Request, slug string) {
+	s.servePost(w, r, func(ctx context.Context) (Post, error) {
+		return s.store.GetBySlug(ctx, slug)
+	})
+}
+
+// servePost writes the post get looks up, in whichever format the client
+// asked for.
+func (s *server) servePost(w http.ResponseWriter, r *http.Request, get func(ctx context.Context) (Post, error)) {
+	format, ok := negotiateFormat(r)
 	if !ok {
-		http.Error(w, "Post not found", http.StatusNotFound)
+		writeError(w, http.StatusNotAcceptable, "not_acceptable", "Not acceptable, supported types are application/json and application/xml")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(p)
+	fields, err := parseFields(r, format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_fields", err.Error())
+		return
+	}
+
+	p, err := get(r.Context())
+	if err == nil && !s.canRead(r.Context(), p) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+
+	// Let clients that already have this version skip the download
+	etag := postETag(p)
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Only full reads count as views, HEAD and 304s don't
+	if s.countViews && r.Method == "GET" {
+		if p, err = s.store.AddView(r.Context(), p.ID); err != nil {
+			handleStoreError(w, err)
+			return
+		}
+	}
+
+	writeFormatted(w, r, format, http.StatusOK, selectFields(p, fields))
 }
 
-func handlePostPost(w http.ResponseWriter, r *http.Request, id int) {
+func (s *server) handlePostPost(w http.ResponseWriter, r *http.Request, id string) {
 	var p Post
 
+	if id == "" && contentType(r) == "multipart/form-data" {
+		s.handleUploadPost(w, r)
+		return
+	}
+
 	// This will read the entire body into a byte slice ([]byte)
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+	body, ok := readBody(w, r)
+	if !ok {
 		return
 	}
 
 	// Now we'll try to parse the body. This is similar to JSON.parse in JavaScript.
 	if err := json.Unmarshal(body, &p); err != nil {
-		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing request body")
 		return
 	}
+	// Only uploads get an attachment
+	p.Attachment = nil
 
-	postsMu.Lock()
-	defer postsMu.Unlock()
+	if err := validatePost(p); err != nil {
+		handleStoreError(w, err)
+		return
+	}
 
-	if id == 0 {
-		p.ID = nextID
-		nextID++
-		posts[p.ID] = p
+	// POST /posts creates, as does POST /post/0 which is kept for clients
+	// from before IDs were UUIDs
+	if id == "" || id == "0" {
+		s.handleCreatePost(w, r, p, body)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		json.NewEncoder(w).Encode(p)
+	// Keep the stored ID and apply the new body on top of it
+	p, err := s.store.Update(r.Context(), id, func(existing *Post) error {
+		if err := checkEdit(r, *existing); err != nil {
+			return err
+		}
+		existing.Title = p.Title
+		existing.Body = p.Body
+		if p.Tags != nil {
+			existing.Tags = p.Tags
+		}
+		return nil
+	})
+	if err != nil {
+		handleStoreError(w, err)
 		return
 	}
+	s.recordAudit(r, "update", p.ID)
+	s.publishPost(r, "updated", p)
+
+	w.Header().Set("ETag", postETag(p))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(p)
+}
 
-	p, ok := posts[id]
+// handleCreatePost creates p, which has already been validated apart from
+// its ID. Clients migrating posts from elsewhere can pick the ID, a taken
+// one gets 409. A client that sends an Idempotency-Key can safely retry:
+// a repeat of a request that already created a post gets that post back
+// instead of another one. It reports whether p was actually stored.
+func (s *server) handleCreatePost(w http.ResponseWriter, r *http.Request, p Post, body []byte) bool {
+	// 0 was "no ID" back when IDs were numbers
+	if p.ID == "0" {
+		p.ID = ""
+	}
+	if err := validatePostID(p.ID); err != nil {
+		handleStoreError(w, err)
+		return false
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	claimed := false
+	if key != "" && s.idempotency != nil {
+		if len(key) > maxIdempotencyKey {
+			writeError(w, http.StatusBadRequest, "invalid_idempotency_key", "Idempotency-Key is too long")
+			return false
+		}
+
+		// Keys are per client and tenant, two of them picking the same key
+		// mustn't get each other's posts
+		key = tenantFrom(r.Context()) + "\x00" + subjectFrom(r.Context()) + "\x00" + key
+		prev, err := s.idempotency.begin(key, sha256.Sum256(body))
+		switch {
+		case errors.Is(err, errIdempotencyMismatch):
+			writeError(w, http.StatusUnprocessableEntity, "idempotency_key_reused", err.Error())
+			return false
+		case errors.Is(err, errIdempotencyInProgress):
+			writeError(w, http.StatusConflict, "idempotency_key_in_use", err.Error())
+			return false
+		case prev != nil:
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeCreated(w, r, *prev)
+			return false
+		}
+		claimed = true
+	}
+
+	p, evicted, err := s.store.Create(r.Context(), withAuthor(r, p))
+	if err != nil {
+		if claimed {
+			s.idempotency.abort(key)
+		}
+		handleStoreError(w, err)
+		return false
+	}
+	if claimed {
+		s.idempotency.finish(key, p)
+	}
+	s.postsEvicted(r, evicted)
+	s.recordAudit(r, "create", p.ID)
+	s.publishPost(r, "created", p)
+	s.notifyCreated(r, p)
+
+	writeCreated(w, r, p)
+	return true
+}
+
+// postsEvicted cleans up after the posts a create in r evicted to stay
+// under -max-posts: they're audited, their files deleted and subscribers
+// hear they're gone.
+func (s *server) postsEvicted(r *http.Request, evicted []Post) {
+	if len(evicted) == 0 {
+		return
+	}
+	s.recordAudit(r, "evict", postIDs(evicted)...)
+	s.postsRemoved(r.Context(), evicted)
+}
+
+// writeCreated sends the 201 response for a newly created post.
+func writeCreated(w http.ResponseWriter, r *http.Request, p Post) {
+	w.Header().Set("Location", apiPrefix(r.Context())+"/post/"+url.PathEscape(p.ID))
+	w.Header().Set("ETag", postETag(p))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *server) handlePutPost(w http.ResponseWriter, r *http.Request, id string) {
+	var p Post
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		writeError(w, http.StatusBadRequest, "body_required", "Request body is required")
+		return
+	}
+
+	if err := json.Unmarshal(body, &p); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing request body")
+		return
+	}
+
+	if err := validatePost(p); err != nil {
+		handleStoreError(w, err)
+		return
+	}
+
+	// PUT replaces the whole post, only the ID is kept from the stored one
+	p, err := s.store.Update(r.Context(), id, func(existing *Post) error {
+		if err := checkEdit(r, *existing); err != nil {
+			return err
+		}
+		*existing = p
+		return nil
+	})
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.recordAudit(r, "update", p.ID)
+	s.publishPost(r, "updated", p)
+
+	w.Header().Set("ETag", postETag(p))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *server) handlePatchPost(w http.ResponseWriter, r *http.Request, id string) {
+	switch contentType(r) {
+	case mergePatchType:
+		s.handleMergePatchPost(w, r, id)
+		return
+	case jsonPatchType:
+		s.handleJSONPatchPost(w, r, id)
+		return
+	}
+
+	var patch PostPatch
+
+	body, ok := readBody(w, r)
 	if !ok {
-		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
 
-	posts[p.ID] = p
+	if err := json.Unmarshal(body, &patch); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing request body: "+err.Error())
+		return
+	}
+
+	p, err := s.store.Update(r.Context(), id, func(p *Post) error {
+		if err := checkEdit(r, *p); err != nil {
+			return err
+		}
+		if patch.Title != nil {
+			p.Title = *patch.Title
+		}
+		if patch.Body != nil {
+			p.Body = *patch.Body
+		}
+		if patch.Tags != nil {
+			p.Tags = *patch.Tags
+		}
+		if patch.ExpiresAt != nil {
+			p.ExpiresAt = patch.ExpiresAt
+		}
+		return validatePost(*p)
+	})
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.recordAudit(r, "update", p.ID)
+	s.publishPost(r, "updated", p)
 
+	w.Header().Set("ETag", postETag(p))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(p)
 }
 
-func handleDeletePost(w http.ResponseWriter, r *http.Request, id int) {
-	postsMu.Lock()
-	defer postsMu.Unlock()
+// handleBulkCreatePosts creates every post in a JSON array in one go. The
+// batch is all or nothing: one invalid entry rejects the lot and the
+// response says which entry it was.
+func (s *server) handleBulkCreatePosts(w http.ResponseWriter, r *http.Request) {
+	var ps []Post
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	if err := json.Unmarshal(body, &ps); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing request body")
+		return
+	}
+
+	for i, p := range ps {
+		if err := validatePost(p); err != nil {
+			e := validationAPIError(err)
+			e.Index = &i
+			writeAPIError(w, http.StatusUnprocessableEntity, e)
+			return
+		}
+	}
+
+	for i := range ps {
+		ps[i] = withAuthor(r, ps[i])
+		ps[i].Attachment = nil
+		// Picking IDs is only for single creates
+		ps[i].ID = ""
+	}
+
+	created, evicted, err := s.store.CreateMany(r.Context(), ps)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.postsEvicted(r, evicted)
+	for _, p := range created {
+		s.recordAudit(r, "create", p.ID)
+		s.publishPost(r, "created", p)
+		s.notifyCreated(r, p)
+	}
+
+	writeJSON(w, http.StatusCreated, created)
+}
+
+// withAuthor fills in the author of a post about to be created with whoever
+// is authenticated, unless the client named one itself. Whoever that is
+// owns the post, whatever the client says.
+func withAuthor(r *http.Request, p Post) Post {
+	p.Author = strings.TrimSpace(p.Author)
+	if p.Author == "" {
+		p.Author = subjectFrom(r.Context())
+	}
+	p.Owner = subjectFrom(r.Context())
+	return p
+}
+
+// handlePopularPosts returns the ?limit= most viewed posts.
+func (s *server) handlePopularPosts(w http.ResponseWriter, r *http.Request) {
+	s.handleTopPosts(w, r, func(a, b Post) int {
+		return cmp.Compare(b.Views, a.Views)
+	})
+}
+
+// handleRecentPosts returns the ?limit= newest posts, newest first. It's
+// GET /posts?order=desc without the paging, for "latest posts" widgets.
+func (s *server) handleRecentPosts(w http.ResponseWriter, r *http.Request) {
+	s.handleTopPosts(w, r, func(a, b Post) int { return 0 })
+}
+
+// handleTopPosts returns the first ?limit= posts ordered by compare, with
+// newer posts first among equals.
+func (s *server) handleTopPosts(w http.ResponseWriter, r *http.Request, compare func(a, b Post) int) {
+	format, ok := negotiateFormat(r)
+	if !ok {
+		writeError(w, http.StatusNotAcceptable, "not_acceptable", "Not acceptable, supported types are application/json and application/xml")
+		return
+	}
+
+	fields, err := parseFields(r, format)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_fields", err.Error())
+		return
+	}
+
+	limit := queryInt(r, "limit", defaultLimit)
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+
+	// List hands back a copy, so sorting it doesn't disturb the store
+	ps, err := s.store.List(r.Context())
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	ps = s.readable(r.Context(), ps)
+	slices.SortFunc(ps, func(a, b Post) int {
+		if c := compare(a, b); c != 0 {
+			return c
+		}
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(b.ID, a.ID)
+	})
+	ps = paginate(ps, 0, limit)
+
+	if format == formatXML {
+		writeFormatted(w, r, format, http.StatusOK, PostList{Posts: ps})
+		return
+	}
+	writeFormatted(w, r, format, http.StatusOK, selectFieldsAll(ps, fields))
+}
+
+// handleCountPosts returns how many posts match the same filters GET /posts
+// accepts, so clients can work out page counts up front.
+func (s *server) handleCountPosts(w http.ResponseWriter, r *http.Request) {
+	all, err := s.store.List(r.Context())
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	all = s.readable(r.Context(), all)
+
+	ps, err := filterPosts(r, all)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_filter", err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"count": len(ps)})
+}
+
+// BulkDeleteResult tells the client which of the IDs it sent to
+// POST /posts/delete were deleted, which didn't exist and which belong to
+// someone else.
+type BulkDeleteResult struct {
+	Deleted   []string `json:"deleted"`
+	NotFound  []string `json:"not_found"`
+	Forbidden []string `json:"forbidden,omitempty"`
+}
+
+// handleBulkDeletePosts deletes every post in a JSON array of IDs. Unknown
+// IDs are reported back but don't stop the others from being deleted.
+func (s *server) handleBulkDeletePosts(w http.ResponseWriter, r *http.Request) {
+	var ids []string
 
-	// If you use a two-value assignment for accessing a
-	// value on a map, you get the value first then an
-	// "exists" variable.
-	_, ok := posts[id]
+	body, ok := readBody(w, r)
 	if !ok {
-		http.Error(w, "Post not found", http.StatusNotFound)
 		return
 	}
 
-	delete(posts, id)
+	if err := json.Unmarshal(body, &ids); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing request body")
+		return
+	}
+
+	// Owners never change, so checking them up front can't race with the
+	// delete
+	var result BulkDeleteResult
+	mine := make([]string, 0, len(ids))
+	owners := make(map[string]string, len(ids))
+	for _, id := range ids {
+		p, err := s.store.Get(r.Context(), id)
+		if err == nil && checkOwner(r, p) != nil {
+			result.Forbidden = append(result.Forbidden, id)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			handleStoreError(w, err)
+			return
+		}
+		mine = append(mine, id)
+		owners[id] = p.Owner
+	}
+
+	deleted, err := s.store.DeleteMany(r.Context(), mine)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.recordAudit(r, "delete", deleted...)
+	for _, id := range deleted {
+		s.publishPost(r, "deleted", Post{ID: id, Owner: owners[id]})
+	}
+
+	result.Deleted, result.NotFound = deleted, []string{}
+	for _, id := range mine {
+		if !slices.Contains(deleted, id) {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleDeleteAllPosts permanently removes every post, soft deleted ones
+// included, along with their uploaded files, and says how many there were.
+// It's for resetting dev and test databases and only reachable with
+// -allow-delete-all.
+func (s *server) handleDeleteAllPosts(w http.ResponseWriter, r *http.Request) {
+	removed, err := s.store.DeleteAll(r.Context())
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.deleteAttachments(r.Context(), removed, nil)
+	s.recordAudit(r, "delete_all")
+	s.publishReset(r)
+	writeJSON(w, http.StatusOK, map[string]int{"deleted": len(removed)})
+}
+
+// handleDeletePost soft deletes a post. It disappears from the API but can
+// be brought back with handleRestorePost.
+func (s *server) handleDeletePost(w http.ResponseWriter, r *http.Request, id string) {
+	// With If-Match only the version the client last saw gets deleted
+	var deleted Post
+	err := s.store.Delete(r.Context(), id, func(p Post) error {
+		deleted = p
+		return checkEdit(r, p)
+	})
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.recordAudit(r, "delete", id)
+	s.publishPost(r, "deleted", deleted)
+
 	w.WriteHeader(http.StatusOK)
 }
 
-func loggerSetup() *log.Logger {
-	logger := log.Default()
-	logger.SetFlags(log.LstdFlags | log.Lshortfile)
-	return logger
+// handleLikePost adds delta to a post's likes, POST /post/{id}/like to
+// like it and DELETE to take the like back, and returns the new count.
+func (s *server) handleLikePost(w http.ResponseWriter, r *http.Request, id string, delta int64) {
+	if err := s.checkRead(r.Context(), id); err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	p, err := s.store.AddLikes(r.Context(), id, delta)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"likes": p.Likes})
 }
 
-func logRequest(handler string, r *http.Request) {
-	msg := fmt.Sprintln(handler, "->", r.Method, r.RequestURI, r.ContentLength)
-	logger.Output(2, msg)
+func (s *server) handleRestorePost(w http.ResponseWriter, r *http.Request, id string) {
+	p, err := s.store.Restore(r.Context(), id, func(p Post) error {
+		if p.expired(time.Now()) {
+			return ErrNotFound
+		}
+		return checkOwner(r, p)
+	})
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.recordAudit(r, "restore", p.ID)
+	s.publishPost(r, "restored", p)
+
+	w.Header().Set("ETag", postETag(p))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(p)
+}
+
+// handleOptions answers an OPTIONS request with the methods the route
+// supports. CORS preflights never get here, withCORS answers those.
+func handleOptions(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// methodNotAllowed rejects a request with 405, listing the methods the
+// route does support in the Allow header as the spec requires.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+}
+
+// readBody reads the whole request body. If that fails it writes the error
+// response itself and returns false.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+			return nil, false
+		}
+		if badGzip(err) || errors.Is(err, io.ErrUnexpectedEOF) {
+			writeError(w, http.StatusBadRequest, "invalid_body", "Request body is truncated or not valid gzip")
+			return nil, false
+		}
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error reading request body")
+		return nil, false
+	}
+	return body, true
+}
+
+// handleStoreError writes the response for an error returned by the store,
+// or by validating a post before handing it to the store. Anything other
+// than a missing or invalid post is unexpected, so it gets logged and the
+// client only sees a generic 500.
+func handleStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, "not_found", "Post not found")
+		return
+	}
+
+	if errors.Is(err, ErrForbidden) {
+		writeError(w, http.StatusForbidden, "forbidden", "Only the post's owner can change it")
+		return
+	}
+
+	if errors.Is(err, ErrIDTaken) {
+		writeError(w, http.StatusConflict, "id_taken", "A post with this ID already exists")
+		return
+	}
+
+	if errors.Is(err, ErrTooManyPosts) {
+		writeError(w, http.StatusUnprocessableEntity, "too_many_posts", "More posts than -max-posts allows")
+		return
+	}
+
+	if errors.Is(err, ErrPreconditionFailed) {
+		writeError(w, http.StatusPreconditionFailed, "precondition_failed", "Post has been modified")
+		return
+	}
+
+	// The request parsed fine but the post breaks our rules, 400 is for
+	// requests we couldn't parse at all
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		writeAPIError(w, http.StatusUnprocessableEntity, validationAPIError(err))
+		return
+	}
+
+	var bad *patchError
+	if errors.As(err, &bad) {
+		writeError(w, bad.status, bad.code, bad.message)
+		return
+	}
+
+	logger.Println("store error:", err)
+	writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
 }
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer serves a server around a fresh in-memory store, routed the
+// way main routes it but without the middleware. configure can change the
+// server's settings before the first request.
+func newTestServer(t *testing.T, configure ...func(s *server)) http.Handler {
+	t.Helper()
+	store, err := newMemoryStore("", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(store)
+	for _, fn := range configure {
+		fn(srv)
+	}
+
+	mux := http.NewServeMux()
+	srv.routes(mux, func(route string, h http.HandlerFunc) http.Handler { return h })
+	return mux
+}
+
+// do sends a request to h and returns the recorded response.
+func do(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decode[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+func createPost(t *testing.T, h http.Handler, title string) Post {
+	t.Helper()
+	rec := do(h, "POST", "/posts", `{"title":"`+title+`","body":"some body"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /posts = %d %s, want 201", rec.Code, rec.Body)
+	}
+	return decode[Post](t, rec)
+}
+
+func TestPostLifecycle(t *testing.T) {
+	h := newTestServer(t)
+
+	p := createPost(t, h, "Hello")
+	if p.ID == "" || p.Title != "Hello" || p.Body != "some body" {
+		t.Fatalf("created %+v", p)
+	}
+	path := "/post/" + p.ID
+
+	rec := do(h, "GET", path, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET = %d, want 200", rec.Code)
+	}
+	if got := decode[Post](t, rec); got.Body != "some body" {
+		t.Errorf("GET body = %q", got.Body)
+	}
+
+	// An update keeps the ID from the path, whatever the body says
+	rec = do(h, "POST", path, `{"id":"other","title":"T","body":"new body"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST update = %d %s, want 200", rec.Code, rec.Body)
+	}
+	if got := decode[Post](t, rec); got.ID != p.ID || got.Body != "new body" {
+		t.Errorf("POST update returned %+v", got)
+	}
+	if got := decode[Post](t, do(h, "GET", path, "")); got.Body != "new body" {
+		t.Errorf("GET after update body = %q", got.Body)
+	}
+
+	if rec := do(h, "DELETE", path, ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE = %d, want 200", rec.Code)
+	}
+	if rec := do(h, "GET", path, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE = %d, want 404", rec.Code)
+	}
+	if rec := do(h, "POST", path, `{"title":"T","body":"x"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("POST update after DELETE = %d, want 404", rec.Code)
+	}
+}
+
+func TestPutPost(t *testing.T) {
+	h := newTestServer(t)
+	p := createPost(t, h, "Old")
+	path := "/post/" + p.ID
+
+	rec := do(h, "PUT", path, `{"id":"other","title":"T","body":"replaced"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT = %d %s, want 200", rec.Code, rec.Body)
+	}
+	if got := decode[Post](t, rec); got.ID != p.ID || got.Body != "replaced" {
+		t.Errorf("PUT returned %+v", got)
+	}
+
+	if rec := do(h, "PUT", path, ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT without a body = %d, want 400", rec.Code)
+	}
+	if rec := do(h, "PUT", "/post/missing", `{"title":"T","body":"x"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("PUT to a missing post = %d, want 404", rec.Code)
+	}
+}
+
+func TestPatchPost(t *testing.T) {
+	h := newTestServer(t)
+	p := createPost(t, h, "Old title")
+	path := "/post/" + p.ID
+
+	// Fields the patch leaves out keep their stored value
+	rec := do(h, "PATCH", path, `{}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("empty PATCH = %d %s, want 200", rec.Code, rec.Body)
+	}
+	if got := decode[Post](t, rec); got.Title != "Old title" || got.Body != "some body" {
+		t.Errorf("empty PATCH changed the post to %+v", got)
+	}
+
+	rec = do(h, "PATCH", path, `{"body":"patched"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d %s, want 200", rec.Code, rec.Body)
+	}
+	if got := decode[Post](t, rec); got.ID != p.ID || got.Title != "Old title" || got.Body != "patched" {
+		t.Errorf("PATCH returned %+v", got)
+	}
+}
+
+func TestCursorPagination(t *testing.T) {
+	h := newTestServer(t)
+	var want []string
+	for i := range 7 {
+		want = append(want, createPost(t, h, "Post "+strconv.Itoa(i)).ID)
+	}
+
+	var got []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(want) {
+			t.Fatal("pagination doesn't end")
+		}
+		rec := do(h, "GET", "/posts?limit=3&cursor="+url.QueryEscape(cursor), "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET page = %d %s", rec.Code, rec.Body)
+		}
+		page := decode[PostsPage](t, rec)
+		for _, p := range page.Posts {
+			got = append(got, p.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+
+		// A post created between pages lands after the ones already seen
+		// and doesn't shift the rest
+		if pages == 0 {
+			want = append(want, createPost(t, h, "Late").ID)
+		}
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("paged through\n%v\nwant\n%v", got, want)
+	}
+
+	if rec := do(h, "GET", "/posts?cursor=nonsense", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET with bad cursor = %d, want 400", rec.Code)
+	}
+}
+
+func TestPageLinks(t *testing.T) {
+	h := newTestServer(t)
+	for i := range 5 {
+		createPost(t, h, "Post "+strconv.Itoa(i))
+	}
+
+	rec := do(h, "GET", "/posts?offset=2&limit=2&q=post", "")
+	want := `</posts?limit=2&offset=0&q=post>; rel="first", ` +
+		`</posts?limit=2&offset=0&q=post>; rel="prev", ` +
+		`</posts?limit=2&offset=4&q=post>; rel="next", ` +
+		`</posts?limit=2&offset=4&q=post>; rel="last"`
+	if got := rec.Header().Get("Link"); got != want {
+		t.Errorf("Link =\n%s\nwant\n%s", got, want)
+	}
+
+	rec = do(h, "GET", "/posts?offset=4&limit=2", "")
+	if got := rec.Header().Get("Link"); strings.Contains(got, `rel="next"`) {
+		t.Errorf("last page has a next link: %s", got)
+	}
+}
+
+func TestCreatedFilters(t *testing.T) {
+	h := newTestServer(t)
+	a := createPost(t, h, "Older")
+	b := createPost(t, h, "Newer")
+
+	list := func(query string) []string {
+		t.Helper()
+		rec := do(h, "GET", "/posts?"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /posts?%s = %d %s", query, rec.Code, rec.Body)
+		}
+		var ids []string
+		for _, p := range decode[[]Post](t, rec) {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+	stamp := func(p Post) string { return url.QueryEscape(p.CreatedAt.Format(time.RFC3339Nano)) }
+
+	if got := list("created_after=" + stamp(a)); !slices.Equal(got, []string{b.ID}) {
+		t.Errorf("created_after = %v, want only %s", got, b.ID)
+	}
+	if got := list("created_before=" + stamp(b)); !slices.Equal(got, []string{a.ID}) {
+		t.Errorf("created_before = %v, want only %s", got, a.ID)
+	}
+	if got := list("created_after=" + stamp(a) + "&created_before=" + stamp(b)); len(got) != 0 {
+		t.Errorf("empty window = %v", got)
+	}
+	if rec := do(h, "GET", "/posts?created_after=yesterday", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("GET with bad created_after = %d, want 400", rec.Code)
+	}
+}
+
+func TestCreateValidation(t *testing.T) {
+	h := newTestServer(t)
+
+	for _, body := range []string{
+		`{"title":"","body":"x"}`,
+		`{"title":"` + strings.Repeat("x", 201) + `","body":"x"}`,
+		`{"title":"x","body":""}`,
+		`{"title":"x","body":" \n\t"}`,
+		`{"title":"x","body":"` + strings.Repeat("é", 20001) + `"}`,
+	} {
+		rec := do(h, "POST", "/posts", body)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("POST %s = %d, want 422", body, rec.Code)
+			continue
+		}
+		if e := decode[struct{ Error APIError }](t, rec); e.Error.Code != "invalid_post" || e.Error.Field == "" {
+			t.Errorf("POST %s error = %+v", body, e.Error)
+		}
+	}
+	if n := len(decode[[]Post](t, do(h, "GET", "/posts", ""))); n != 0 {
+		t.Errorf("%d posts after rejected creates, want 0", n)
+	}
+
+	// The limit counts characters, not bytes
+	if rec := do(h, "POST", "/posts", `{"title":"x","body":"`+strings.Repeat("é", 20000)+`"}`); rec.Code != http.StatusCreated {
+		t.Errorf("POST of a body at the limit = %d, want 201", rec.Code)
+	}
+}
+
+func TestPickedID(t *testing.T) {
+	h := newTestServer(t)
+	rec := do(h, "POST", "/posts", `{"id":"hello_1","title":"T","body":"x"}`)
+	if rec.Code != http.StatusCreated || decode[Post](t, rec).ID != "hello_1" {
+		t.Fatalf("POST with a picked ID = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(h, "GET", "/post/hello_1", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET of picked ID = %d", rec.Code)
+	}
+
+	// Deleted posts keep their ID, they can still be restored
+	do(h, "DELETE", "/post/hello_1", "")
+	if rec := do(h, "POST", "/posts", `{"id":"hello_1","title":"T","body":"x"}`); rec.Code != http.StatusConflict {
+		t.Errorf("POST with a taken ID = %d, want 409", rec.Code)
+	}
+
+	for _, id := range []string{"slug", "has space", "a/b", strings.Repeat("x", maxIDLength+1)} {
+		if rec := do(h, "POST", "/posts", `{"id":"`+id+`","title":"T","body":"x"}`); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("POST with ID %q = %d, want 422", id, rec.Code)
+		}
+	}
+	if rec := do(h, "POST", "/posts", `{"id":"0","title":"T","body":"x"}`); rec.Code != http.StatusCreated || decode[Post](t, rec).ID == "0" {
+		t.Errorf(`POST with ID "0" = %d %s, want a fresh ID`, rec.Code, rec.Body)
+	}
+}
+
+func TestRestorePost(t *testing.T) {
+	h := newTestServer(t)
+	p := createPost(t, h, "body")
+
+	do(h, "DELETE", "/post/"+p.ID, "")
+	rec := do(h, "POST", "/post/"+p.ID+"/restore", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore = %d %s, want 200", rec.Code, rec.Body)
+	}
+	if got := decode[Post](t, rec); got.Deleted || got.Title != "body" {
+		t.Errorf("restore returned %+v", got)
+	}
+	if rec := do(h, "GET", "/post/"+p.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("GET after restore = %d, want 200", rec.Code)
+	}
+}
+
+func TestBulkCreate(t *testing.T) {
+	h := newTestServer(t)
+
+	rec := do(h, "POST", "/posts/bulk", `[{"title":"T","body":"ok"},{"title":"T","body":" "}]`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("bulk POST with an invalid entry = %d, want 422", rec.Code)
+	}
+	if e := decode[struct{ Error APIError }](t, rec); e.Error.Index == nil || *e.Error.Index != 1 {
+		t.Errorf("bulk POST error index = %v, want 1", e.Error.Index)
+	}
+	if n := len(decode[[]Post](t, do(h, "GET", "/posts", ""))); n != 0 {
+		t.Errorf("%d posts after rejected bulk, want 0", n)
+	}
+
+	rec = do(h, "POST", "/posts/bulk", `[{"title":"T","body":"one"},{"title":"T","body":"two"}]`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("bulk POST = %d %s, want 201", rec.Code, rec.Body)
+	}
+	if created := decode[[]Post](t, rec); len(created) != 2 || created[0].ID == "" || created[1].Body != "two" {
+		t.Errorf("bulk POST returned %+v", created)
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	h := newTestServer(t)
+	p := createPost(t, h, "body")
+
+	etag := do(h, "GET", "/post/"+p.ID, "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET sent no ETag")
+	}
+	if rec := do(h, "GET", "/post/"+p.ID, "", "If-None-Match", "W/"+etag); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("GET with matching If-None-Match = %d %q, want an empty 304", rec.Code, rec.Body)
+	}
+
+	do(h, "PATCH", "/post/"+p.ID, `{"body":"changed"}`)
+	if rec := do(h, "GET", "/post/"+p.ID, "", "If-None-Match", etag); rec.Code != http.StatusOK {
+		t.Errorf("GET with stale If-None-Match = %d, want 200", rec.Code)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	h := newTestServer(t)
+	p := createPost(t, h, "versioned")
+
+	etag := do(h, "GET", "/post/"+p.ID, "").Header().Get("ETag")
+	if rec := do(h, "PUT", "/post/"+p.ID, `{"title":"T","body":"b"}`, "If-Match", `"stale"`); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with stale If-Match = %d, want 412", rec.Code)
+	}
+	rec := do(h, "PUT", "/post/"+p.ID, `{"title":"T","body":"b"}`, "If-Match", etag)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT with current If-Match = %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	// The PUT changed the post, so the old tag no longer matches
+	if rec := do(h, "PATCH", "/post/"+p.ID, `{"body":"c"}`, "If-Match", etag); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with old If-Match = %d, want 412", rec.Code)
+	}
+	rec = do(h, "PATCH", "/post/"+p.ID, `{"body":"c"}`, "If-Match", rec.Header().Get("ETag"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH with the tag PUT returned = %d, want 200", rec.Code)
+	}
+
+	if rec := do(h, "DELETE", "/post/"+p.ID, "", "If-Match", etag); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with old If-Match = %d, want 412", rec.Code)
+	}
+	if rec := do(h, "DELETE", "/post/"+p.ID, "", "If-Match", rec.Header().Get("ETag")); rec.Code != http.StatusOK {
+		t.Errorf("DELETE with current If-Match = %d, want 200", rec.Code)
+	}
+}
+
+func TestDeleteAllPosts(t *testing.T) {
+	if rec := do(newTestServer(t), "DELETE", "/posts", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /posts while disabled = %d, want 405", rec.Code)
+	}
+
+	h := newTestServer(t, func(s *server) { s.allowDeleteAll = true })
+	createPost(t, h, "a")
+	gone := createPost(t, h, "b")
+	do(h, "DELETE", "/post/"+gone.ID, "")
+
+	rec := do(h, "DELETE", "/posts", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /posts = %d %s", rec.Code, rec.Body)
+	}
+	// Soft deleted posts count too, and can't be restored afterwards
+	if n := decode[map[string]int](t, rec)["deleted"]; n != 2 {
+		t.Errorf("deleted %d posts, want 2", n)
+	}
+	if rec := do(h, "POST", "/post/"+gone.ID+"/restore", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("restore after DELETE /posts = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"runtime/debug"
+)
+
+// Middleware wraps a handler with some behaviour of its own, running
+// before and/or after it.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h in mws. The first middleware is the outermost one, so the
+// list reads in the order a request passes through them.
+func Chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// contextKey is the type of the keys our middleware stores values under in
+// a request's context, so they can't clash with other packages' keys.
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+// maxRequestIDLength caps how much of a client supplied X-Request-ID we're
+// willing to echo back and log.
+const maxRequestIDLength = 128
+
+// withRequestID gives every request an ID, reusing the caller's
+// X-Request-ID when it sent a sensible one. The ID is stored in the
+// request context for logRequest and echoed back in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requestIDFrom returns the ID withRequestID assigned to the request, or
+// an empty string if it didn't run.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether an incoming ID is safe to put in our
+// logs and headers: non-empty, not too long and printable ASCII only.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// withRecovery turns a panicking handler into a 500 response instead of a
+// dropped connection, and logs the panic with its stack trace.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// net/http uses this panic on purpose to abort a response
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			logger.Printf("panic serving %s %s [%s]: %v\n%s", r.Method, r.URL.Path, requestIDFrom(r.Context()), err, debug.Stack())
+			writeError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withReadOnly turns away every request that could change something with
+// a 503 when readOnly is set, for maintenance windows where reads should
+// keep working. OPTIONS and CORS preflights only ask, so they get through.
+func withReadOnly(readOnly bool) Middleware {
+	return func(next http.Handler) http.Handler {
+		if !readOnly {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "GET", "HEAD", "OPTIONS":
+				next.ServeHTTP(w, r)
+			default:
+				writeError(w, http.StatusServiceUnavailable, "read_only", "Server is in read-only mode for maintenance, writes are disabled")
+			}
+		})
+	}
+}
+
+// withMaxBody caps request bodies of methods that carry one at limit
+// bytes. Reading past the limit fails with an *http.MaxBytesError, which
+// readBody turns into a 413. Requests carrying a file, see isUpload, get
+// uploadLimit instead.
+func withMaxBody(limit, uploadLimit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "POST", "PUT", "PATCH":
+				n := limit
+				if isUpload(r) {
+					n = uploadLimit
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, n)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// statusRecorder wraps a ResponseWriter to remember the status code and
+// number of bytes the handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, for
+// things like flushing.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Hijack hands the connection over for a WebSocket, the only response on
+// it is the 101 the upgrade sends itself.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Status returns the status code sent, which is 200 if the handler never
+// called WriteHeader explicitly.
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mark("outer"), mark("middle"), mark("inner"))
+	do(h, "GET", "/", "")
+
+	if want := []string{"outer", "middle", "inner", "handler"}; !slices.Equal(order, want) {
+		t.Errorf("ran %v, want %v", order, want)
+	}
+}
+
+func TestMetricMethod(t *testing.T) {
+	for method, want := range map[string]string{
+		"GET":    "GET",
+		"DELETE": "DELETE",
+		"BREW":   "other",
+		"get":    "other",
+	} {
+		if got := metricMethod(method); got != want {
+			t.Errorf("metricMethod(%q) = %q, want %q", method, got, want)
+		}
+	}
+}
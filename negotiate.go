@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Response formats the read handlers can produce.
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+)
+
+// PostList is how a list of posts is wrapped in XML, which needs a single
+// root element. JSON clients get a bare array.
+type PostList struct {
+	XMLName xml.Name `xml:"posts"`
+	Posts   []Post   `xml:"post"`
+}
+
+// contentType returns the media type of the request body, without any
+// parameters.
+func contentType(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType
+}
+
+// negotiateFormat picks the response format from the Accept header. JSON
+// wins when the client doesn't care. It returns false if the client only
+// accepts types we can't produce.
+func negotiateFormat(r *http.Request) (string, bool) {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatJSON, true
+	}
+
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+
+		var format string
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			format = formatJSON
+		case "application/xml", "text/xml":
+			format = formatXML
+		default:
+			continue
+		}
+
+		// On a tie the first listed type wins
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+
+	return best, best != ""
+}
+
+// writeFormatted sends v encoded in format with the given status. Output is
+// compact unless the request asked for ?pretty=true, which is nicer to read
+// when poking at the API with curl.
+func writeFormatted(w http.ResponseWriter, r *http.Request, format string, status int, v any) {
+	pretty := r.URL.Query().Get("pretty") == "true"
+
+	w.Header().Add("Vary", "Accept")
+	if format == formatXML {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		w.Write([]byte(xml.Header))
+		enc := xml.NewEncoder(w)
+		if pretty {
+			enc.Indent("", "  ")
+		}
+		enc.Encode(v)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	if pretty {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
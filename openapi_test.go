@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPISpec checks every operation openapi.json describes is one we
+// serve, so the spec can't name routes that were moved or removed.
+func TestOpenAPISpec(t *testing.T) {
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("openapi = %q, want 3.x", spec.OpenAPI)
+	}
+
+	h := newTestServer(t, func(s *server) { s.allowDeleteAll = true })
+	p := createPost(t, h, "Spec")
+	r := strings.NewReplacer("{id}", p.ID, "{slug}", p.Slug)
+	for path, ops := range spec.Paths {
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			method = strings.ToUpper(method)
+			if method == "GET" && strings.HasSuffix(path, "/events") {
+				// Streams until the client goes away
+				continue
+			}
+			// The fallback's answers, as opposed to a handler's 404
+			rec := do(h, method, r.Replace(path), "")
+			if rec.Code == http.StatusMethodNotAllowed || strings.Contains(rec.Body.String(), `"message":"Not found"`) {
+				t.Errorf("%s %s is in the spec but not served", method, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrForbidden is returned when someone other than a post's owner tries
+// to change it.
+var ErrForbidden = errors.New("post belongs to someone else")
+
+// A post's Owner is whoever was authenticated when it was created, it's
+// never taken from the request body and never changes. Only the owner
+// can edit or delete a post. Posts created without authentication, or
+// with an API key, which doesn't name anyone, have no owner and stay
+// open to every authenticated client.
+
+// checkOwner returns ErrForbidden unless the caller owns p or p has no
+// owner.
+func checkOwner(r *http.Request, p Post) error {
+	if p.Owner != "" && p.Owner != subjectFrom(r.Context()) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// checkEdit is what every change to an existing post has to pass: it has
+// to be the caller's, and the version the caller last saw if they sent
+// If-Match. An expired post can't be read, so it can't be changed either.
+func checkEdit(r *http.Request, p Post) error {
+	if p.expired(time.Now()) {
+		return ErrNotFound
+	}
+	if err := checkOwner(r, p); err != nil {
+		return err
+	}
+	return checkIfMatch(r, p)
+}
+
+// canRead reports whether the caller gets to see p. Reads are open
+// unless -private-posts limits each client to its own posts, and the
+// ones without an owner. An expired post is gone for everyone, even
+// before the sweep gets to it.
+func (s *server) canRead(ctx context.Context, p Post) bool {
+	if p.expired(time.Now()) {
+		return false
+	}
+	return !s.privatePosts || p.Owner == "" || p.Owner == subjectFrom(ctx)
+}
+
+// readable keeps the posts in ps the caller gets to see.
+func (s *server) readable(ctx context.Context, ps []Post) []Post {
+	out := ps[:0]
+	for _, p := range ps {
+		if s.canRead(ctx, p) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// checkRead returns ErrNotFound if the caller doesn't get to see the post
+// with the given ID, for handlers that work on a post without loading it.
+// Someone else's post looks like no post at all.
+func (s *server) checkRead(ctx context.Context, id string) error {
+	p, err := s.store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !s.canRead(ctx, p) {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestOwnership(t *testing.T) {
+	var srv *server
+	h := newTestServer(t, func(s *server) { srv = s })
+	ann, bob := asSubject("ann", h), asSubject("bob", h)
+
+	rec := do(ann, "POST", "/posts", `{"title":"Mine","body":"b","owner":"bob"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /posts = %d %s", rec.Code, rec.Body)
+	}
+	p := decode[Post](t, rec)
+	if p.Owner != "ann" {
+		t.Fatalf("owner = %q, want ann whatever the body says", p.Owner)
+	}
+	open := createPost(t, h, "Open")
+
+	for _, tc := range []struct{ method, target, body string }{
+		{"PUT", "/post/" + p.ID, `{"title":"Taken","body":"b"}`},
+		{"PATCH", "/post/" + p.ID, `{"title":"Taken"}`},
+		{"DELETE", "/post/" + p.ID, ""},
+	} {
+		if rec := do(bob, tc.method, tc.target, tc.body); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s by someone else = %d, want 403", tc.method, tc.target, rec.Code)
+		}
+	}
+	if rec := do(bob, "PATCH", "/post/"+open.ID, `{"title":"Anyone's"}`); rec.Code != http.StatusOK {
+		t.Errorf("PATCH of a post without owner = %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	rec = do(bob, "POST", "/posts/delete", `["`+p.ID+`","`+open.ID+`"]`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /posts/delete = %d %s", rec.Code, rec.Body)
+	}
+	if res := decode[BulkDeleteResult](t, rec); len(res.Forbidden) != 1 || res.Forbidden[0] != p.ID {
+		t.Errorf("forbidden = %v, want only %s", res.Forbidden, p.ID)
+	}
+	if rec := do(h, "GET", "/post/"+open.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("open post after bulk delete = %d, want 404", rec.Code)
+	}
+	if rec := do(h, "GET", "/post/"+p.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("owned post after someone else's bulk delete = %d, want 200", rec.Code)
+	}
+
+	if rec := do(ann, "DELETE", "/post/"+p.ID, ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE by owner = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(bob, "POST", "/post/"+p.ID+"/restore", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("restore by someone else = %d, want 403", rec.Code)
+	}
+	if rec := do(ann, "POST", "/post/"+p.ID+"/restore", ""); rec.Code != http.StatusOK {
+		t.Errorf("restore by owner = %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	srv.privatePosts = true
+	if rec := do(bob, "GET", "/post/"+p.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("private GET of someone else's post = %d, want 404", rec.Code)
+	}
+	if rec := do(ann, "GET", "/post/"+p.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("private GET of own post = %d, want 200", rec.Code)
+	}
+	if ps := decode[[]Post](t, do(bob, "GET", "/posts", "")); len(ps) != 0 {
+		t.Errorf("private list shows %d posts of someone else", len(ps))
+	}
+	if ps := decode[[]Post](t, do(ann, "GET", "/posts", "")); len(ps) != 1 || ps[0].ID != p.ID {
+		t.Errorf("private list = %+v, want only the own post", ps)
+	}
+}
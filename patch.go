@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Content types PATCH /post/{id} accepts besides plain JSON, which is
+// handled as a PostPatch.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// patchError is returned from inside an Update closure when a patch can't
+// be applied to the stored post. handleStoreError sends it as is.
+type patchError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *patchError) Error() string {
+	return e.message
+}
+
+// handleMergePatchPost applies an RFC 7386 merge patch to a post: keys in
+// the patch replace the stored ones, null removes them and anything left
+// out is kept.
+func (s *server) handleMergePatchPost(w http.ResponseWriter, r *http.Request, id string) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var patch any
+	if err := json.Unmarshal(body, &patch); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing merge patch: "+err.Error())
+		return
+	}
+
+	p, err := s.store.Update(r.Context(), id, func(p *Post) error {
+		if err := checkEdit(r, *p); err != nil {
+			return err
+		}
+		if err := patchPost(p, func(doc any) (any, error) {
+			return mergePatch(doc, patch), nil
+		}); err != nil {
+			return err
+		}
+		return validatePost(*p)
+	})
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.recordAudit(r, "update", p.ID)
+	s.publishPost(r, "updated", p)
+
+	w.Header().Set("ETag", postETag(p))
+	writeJSON(w, http.StatusOK, p)
+}
+
+// patchPost runs apply on the JSON form of p and decodes the result back
+// into it. Working on the JSON document means patches address fields by
+// the same names clients see.
+func patchPost(p *Post, apply func(doc any) (any, error)) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	doc, err = apply(doc)
+	if err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var patched Post
+	if err := json.Unmarshal(data, &patched); err != nil {
+		return &patchError{http.StatusBadRequest, "invalid_patch", "Patched post is invalid: " + err.Error()}
+	}
+	*p = patched
+	return nil
+}
+
+// mergePatch is the MergePatch function from RFC 7386.
+func mergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
+// jsonPatchOp is one operation of an RFC 6902 JSON patch. Only add, remove
+// and replace are supported.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+
+	tokens []string
+	value  any
+}
+
+// handleJSONPatchPost applies an RFC 6902 JSON patch to a post. The
+// operations are applied in order and if any of them fails none of them
+// are saved.
+func (s *server) handleJSONPatchPost(w http.ResponseWriter, r *http.Request, id string) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing JSON patch: "+err.Error())
+		return
+	}
+
+	// Check the whole document up front so a bad operation is a 400
+	// rather than whatever the operations before it would have caused
+	for i := range ops {
+		if err := ops[i].parse(); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_patch", "Operation "+strconv.Itoa(i)+": "+err.Error())
+			return
+		}
+	}
+
+	p, err := s.store.Update(r.Context(), id, func(p *Post) error {
+		if err := checkEdit(r, *p); err != nil {
+			return err
+		}
+		if err := patchPost(p, func(doc any) (any, error) {
+			for _, op := range ops {
+				var err error
+				if doc, err = op.apply(doc, op.tokens); err != nil {
+					return nil, err
+				}
+			}
+			return doc, nil
+		}); err != nil {
+			return err
+		}
+		return validatePost(*p)
+	})
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	s.recordAudit(r, "update", p.ID)
+	s.publishPost(r, "updated", p)
+
+	w.Header().Set("ETag", postETag(p))
+	writeJSON(w, http.StatusOK, p)
+}
+
+// parse checks the operation and splits its path into JSON pointer
+// reference tokens.
+func (op *jsonPatchOp) parse() error {
+	switch op.Op {
+	case "add", "replace":
+		if len(op.Value) == 0 {
+			return errors.New(op.Op + " needs a value")
+		}
+		if err := json.Unmarshal(op.Value, &op.value); err != nil {
+			return err
+		}
+	case "remove":
+	default:
+		return errors.New("unsupported op " + strconv.Quote(op.Op))
+	}
+
+	if op.Path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(op.Path, "/") {
+		return errors.New("path must start with /")
+	}
+	for _, t := range strings.Split(op.Path[1:], "/") {
+		t = strings.ReplaceAll(t, "~1", "/")
+		t = strings.ReplaceAll(t, "~0", "~")
+		op.tokens = append(op.tokens, t)
+	}
+	return nil
+}
+
+// apply performs the operation on doc at the location given by tokens and
+// returns the new document. Paths that don't exist are a 422, since the
+// patch itself was fine but doesn't fit the post.
+func (op *jsonPatchOp) apply(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		if op.Op == "remove" {
+			return nil, op.missing()
+		}
+		return op.value, nil
+	}
+
+	key, last := tokens[0], len(tokens) == 1
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[key]
+		if !ok && !(last && op.Op == "add") {
+			return nil, op.missing()
+		}
+		switch {
+		case !last:
+			v, err := op.apply(child, tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			node[key] = v
+		case op.Op == "remove":
+			delete(node, key)
+		default:
+			node[key] = op.value
+		}
+		return node, nil
+
+	case []any:
+		if last && op.Op == "add" && key == "-" {
+			return append(node, op.value), nil
+		}
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i > len(node) || (i == len(node) && !(last && op.Op == "add")) {
+			return nil, op.missing()
+		}
+		switch {
+		case !last:
+			v, err := op.apply(node[i], tokens[1:])
+			if err != nil {
+				return nil, err
+			}
+			node[i] = v
+			return node, nil
+		case op.Op == "add":
+			return append(node[:i], append([]any{op.value}, node[i:]...)...), nil
+		case op.Op == "remove":
+			return append(node[:i], node[i+1:]...), nil
+		default:
+			node[i] = op.value
+			return node, nil
+		}
+	}
+	return nil, op.missing()
+}
+
+func (op *jsonPatchOp) missing() error {
+	return &patchError{http.StatusUnprocessableEntity, "invalid_path", "Path " + strconv.Quote(op.Path) + " does not exist"}
+}
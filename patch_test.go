@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	// The examples from RFC 7386 appendix A
+	for _, tc := range []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		var target, patch, want any
+		json.Unmarshal([]byte(tc.target), &target)
+		json.Unmarshal([]byte(tc.patch), &patch)
+		json.Unmarshal([]byte(tc.want), &want)
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+			t.Errorf("mergePatch(%s, %s) = %v, want %s", tc.target, tc.patch, got, tc.want)
+		}
+	}
+}
+
+func TestMergePatchPost(t *testing.T) {
+	h := newTestServer(t)
+	rec := do(h, "POST", "/posts", `{"title":"T","body":"body","author":"ann","tags":["a","b"]}`)
+	p := decode[Post](t, rec)
+
+	ct := []string{"Content-Type", mergePatchType}
+	// Server controlled fields can't be patched
+	rec = do(h, "PATCH", "/post/"+p.ID, `{"tags":["c"],"author":"bob","id":"other"}`, ct...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("merge PATCH = %d %s, want 200", rec.Code, rec.Body)
+	}
+	got := decode[Post](t, rec)
+	if got.ID != p.ID || got.Body != "body" || got.Author != "ann" || !slices.Equal(got.Tags, []string{"c"}) {
+		t.Errorf("merge PATCH returned %+v", got)
+	}
+
+	rec = do(h, "PATCH", "/post/"+p.ID, `{"tags":null}`, ct...)
+	if got := decode[Post](t, rec); rec.Code != http.StatusOK || len(got.Tags) != 0 {
+		t.Errorf("merge PATCH removing tags = %d %+v", rec.Code, got)
+	}
+
+	// The patched post is validated like any other update
+	if rec := do(h, "PATCH", "/post/"+p.ID, `{"body":null}`, ct...); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("merge PATCH removing the body = %d, want 422", rec.Code)
+	}
+	if rec := do(h, "PATCH", "/post/"+p.ID, `{"tags":"not a list"}`, ct...); rec.Code != http.StatusBadRequest {
+		t.Errorf("merge PATCH with a mistyped field = %d, want 400", rec.Code)
+	}
+	if got := decode[Post](t, do(h, "GET", "/post/"+p.ID, "")); got.Body != "body" {
+		t.Errorf("rejected patches changed the post to %+v", got)
+	}
+}
+
+func TestJSONPatchPost(t *testing.T) {
+	h := newTestServer(t)
+	p := decode[Post](t, do(h, "POST", "/posts", `{"title":"T","body":"body","tags":["a","b"]}`))
+	ct := []string{"Content-Type", jsonPatchType}
+
+	rec := do(h, "PATCH", "/post/"+p.ID, `[
+		{"op":"add","path":"/tags/-","value":"d"},
+		{"op":"add","path":"/tags/0","value":"z"},
+		{"op":"remove","path":"/tags/1"},
+		{"op":"replace","path":"/body","value":"patched"}
+	]`, ct...)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("JSON PATCH = %d %s, want 200", rec.Code, rec.Body)
+	}
+	got := decode[Post](t, rec)
+	if got.Body != "patched" || !slices.Equal(got.Tags, []string{"z", "b", "d"}) {
+		t.Errorf("JSON PATCH returned %+v", got)
+	}
+
+	// One operation failing drops the ones before it too
+	rec = do(h, "PATCH", "/post/"+p.ID, `[
+		{"op":"replace","path":"/body","value":"lost"},
+		{"op":"remove","path":"/nothing/here"}
+	]`, ct...)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("JSON PATCH with a missing path = %d, want 422", rec.Code)
+	}
+	if got := decode[Post](t, do(h, "GET", "/post/"+p.ID, "")); got.Body != "patched" {
+		t.Errorf("failed JSON PATCH left body %q", got.Body)
+	}
+
+	for _, body := range []string{
+		`[{"op":"move","from":"/body","path":"/title"}]`,
+		`[{"op":"add","path":"/tags/-"}]`,
+		`[{"op":"remove","path":"body"}]`,
+		`{"op":"remove","path":"/body"}`,
+	} {
+		if rec := do(h, "PATCH", "/post/"+p.ID, body, ct...); rec.Code != http.StatusBadRequest {
+			t.Errorf("JSON PATCH %s = %d, want 400", body, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// rateLimitIdle is how long a client can go quiet before its bucket is
+	// thrown away. By then it would have refilled completely anyway.
+	rateLimitIdle = 3 * time.Minute
+	// rateLimitSweep is how often idle buckets are looked for.
+	rateLimitSweep = time.Minute
+)
+
+// ipRateLimiter hands out a token bucket per client IP.
+type ipRateLimiter struct {
+	mu         sync.Mutex
+	clients    map[string]*rateLimitClient
+	limit      rate.Limit
+	burst      int
+	trustProxy bool
+}
+
+type rateLimitClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newIPRateLimiter allows each IP perSecond requests with bursts of up to
+// burst. When trustProxy is set the client IP is taken from
+// X-Forwarded-For, which is only safe behind a proxy that sets it.
+func newIPRateLimiter(perSecond float64, burst int, trustProxy bool) *ipRateLimiter {
+	l := &ipRateLimiter{
+		clients:    make(map[string]*rateLimitClient),
+		limit:      rate.Limit(perSecond),
+		burst:      burst,
+		trustProxy: trustProxy,
+	}
+	go l.sweep()
+	return l
+}
+
+func (l *ipRateLimiter) limiter(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &rateLimitClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter
+}
+
+// sweep forgets clients that haven't been seen for a while so the map
+// doesn't grow with every IP that ever talked to us.
+func (l *ipRateLimiter) sweep() {
+	for range time.Tick(rateLimitSweep) {
+		l.mu.Lock()
+		for ip, c := range l.clients {
+			if time.Since(c.lastSeen) > rateLimitIdle {
+				delete(l.clients, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// clientIP works out which IP a request should be accounted to.
+func (l *ipRateLimiter) clientIP(r *http.Request) string {
+	if l.trustProxy {
+		// The last entry is the one added by the proxy right in front of
+		// us, anything before it is whatever the client claimed
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// withRateLimit rejects requests from clients that have used up their
+// bucket with 429 and a Retry-After telling them when to come back. A nil
+// limiter disables the check.
+func withRateLimit(l *ipRateLimiter) Middleware {
+	return func(next http.Handler) http.Handler {
+		if l == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res := l.limiter(l.clientIP(r)).Reserve()
+			if delay := res.Delay(); delay > 0 {
+				// We're not going to wait, so give the token back
+				res.Cancel()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+const releaseSlotKey contextKey = "release_slot"
+
+// withConcurrencyLimit caps how many requests are handled at once across
+// every route sharing sem, a buffered channel with one slot per request.
+// When all slots are taken the request is turned away with 503 straight
+// away rather than queued, so a spike can't pile up goroutines and
+// memory. A nil sem means no limit.
+func withConcurrencyLimit(sem chan struct{}) Middleware {
+	return func(next http.Handler) http.Handler {
+		if sem == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case sem <- struct{}{}:
+				var once sync.Once
+				release := func() { once.Do(func() { <-sem }) }
+				defer release()
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), releaseSlotKey, release)))
+			default:
+				w.Header().Set("Retry-After", "1")
+				writeError(w, http.StatusServiceUnavailable, "overloaded", "Server is busy, try again shortly")
+			}
+		})
+	}
+}
+
+// releaseSlot gives back r's withConcurrencyLimit slot early. Streams that
+// stay open as long as their client likes call it once they're set up,
+// otherwise a handful of subscribers would lock out every other request.
+func releaseSlot(r *http.Request) {
+	if release, ok := r.Context().Value(releaseSlotKey).(func()); ok {
+		release()
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Resumable uploads are for files too big to send in one request, videos
+// mostly. A client starts one with POST /uploads, sends the file in chunks
+// with PUT /uploads/{id} and a Content-Range header, and after a dropped
+// connection asks GET /uploads/{id} how far it got. The chunk that ends
+// the file moves it into storage under media/{id}.
+//
+// All the state is in the files: an unfinished upload is a file in
+// partial/ under the upload directory and its offset is that file's size,
+// so uploads survive a restart. Who started the upload and the type they
+// said the file is are kept in meta/. Both are always on local disk,
+// whatever the StorageBackend, because chunks are appended to the partial
+// file. Unfinished uploads nobody has added to for -upload-ttl are swept
+// away.
+const (
+	partialDir = "partial"
+	metaDir    = "meta"
+)
+
+// uploadSweep is how often abandoned uploads are looked for.
+const uploadSweep = time.Hour
+
+// uploadMeta is what's known about an upload besides its bytes.
+type uploadMeta struct {
+	// Owner is the subject that started the upload, nobody else gets to
+	// see or add to it
+	Owner string `json:"owner,omitempty"`
+	// Tenant is the tenant the upload was started in, the video belongs
+	// to that tenant's posts
+	Tenant string `json:"tenant,omitempty"`
+	// ContentType is the type the client declared when it started the
+	// upload, and once it's complete the type it was accepted as
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// uploadStatus is the response body of the /uploads endpoints.
+type uploadStatus struct {
+	ID string `json:"id"`
+	// Offset is how many bytes have been received, the next chunk has to
+	// start there
+	Offset      int64  `json:"offset"`
+	Complete    bool   `json:"complete"`
+	ContentType string `json:"content_type,omitempty"`
+	// URL is where a complete upload can be streamed from
+	URL string `json:"url,omitempty"`
+}
+
+// uploadLocks makes sure only one chunk is written to an upload at a
+// time. The zero value is ready to use.
+type uploadLocks struct {
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+// lock claims id, it returns false if another request already has it.
+func (l *uploadLocks) lock(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.busy[id] {
+		return false
+	}
+	if l.busy == nil {
+		l.busy = make(map[string]bool)
+	}
+	l.busy[id] = true
+	return true
+}
+
+func (l *uploadLocks) unlock(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.busy, id)
+}
+
+// handleStartUpload creates an empty upload and returns its ID. The
+// client can say what type the file is in X-Upload-Content-Type, which is
+// used if sniffing the finished file can't tell.
+func (s *server) handleStartUpload(w http.ResponseWriter, r *http.Request) {
+	id := uuid.NewString()
+	m := uploadMeta{Owner: subjectFrom(r.Context()), Tenant: tenantFrom(r.Context()), ContentType: r.Header.Get("X-Upload-Content-Type")}
+	if err := s.writeUploadMeta(id, m); err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Join(s.uploadDir, partialDir), 0o755); err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	f, err := os.OpenFile(s.partialPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Location", apiPrefix(r.Context())+"/uploads/"+id)
+	writeUploadStatus(w, http.StatusCreated, uploadStatus{ID: id})
+}
+
+// handleGetUpload tells a client how much of an upload has arrived, so it
+// knows where to resume.
+func (s *server) handleGetUpload(w http.ResponseWriter, r *http.Request, id string) {
+	st, err := s.uploadStatus(r.Context(), id)
+	if err != nil {
+		s.writeChunkError(w, err)
+		return
+	}
+	writeUploadStatus(w, http.StatusOK, st)
+}
+
+// handlePutChunk appends the request body to an upload. Its Content-Range
+// has to start where the upload currently ends. If the connection drops
+// midway whatever arrived is kept, the client finds the new offset with
+// GET and carries on from there. That's unless the body is signed: then
+// only a chunk that arrived whole and matched its signature is kept.
+func (s *server) handlePutChunk(w http.ResponseWriter, r *http.Request, id string) {
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_content_range", err.Error())
+		return
+	}
+	if total > s.maxUpload || end >= s.maxUpload {
+		writeError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("File is larger than %d bytes", s.maxUpload))
+		return
+	}
+
+	if !s.chunks.lock(id) {
+		writeError(w, http.StatusConflict, "upload_in_progress", "Another chunk is being written to this upload")
+		return
+	}
+	defer s.chunks.unlock(id)
+
+	st, err := s.uploadStatus(r.Context(), id)
+	if err != nil {
+		s.writeChunkError(w, err)
+		return
+	}
+	if st.Complete {
+		writeError(w, http.StatusConflict, "upload_complete", "Upload is already complete")
+		return
+	}
+	if start != st.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+		writeError(w, http.StatusConflict, "offset_mismatch", fmt.Sprintf("Chunk must start at byte %d", st.Offset))
+		return
+	}
+
+	f, err := os.OpenFile(s.partialPath(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		s.writeChunkError(w, err)
+		return
+	}
+	// A big chunk can take longer than -read-timeout to arrive
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+	want := end - start + 1
+	n, err := io.Copy(f, io.LimitReader(r.Body, want))
+	if err == nil {
+		// A signed body is only checked once it's been read to the end
+		_, err = io.Copy(io.Discard, r.Body)
+	}
+	if err != nil && bodySigned(r.Context()) {
+		// Nothing of a chunk we couldn't check is kept
+		if terr := f.Truncate(start); terr == nil {
+			n = 0
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	st.Offset += n
+	if err != nil {
+		s.writeChunkError(w, err)
+		return
+	}
+	if n < want {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+		writeError(w, http.StatusBadRequest, "incomplete_chunk", fmt.Sprintf("Chunk ended after %d of %d bytes", n, want))
+		return
+	}
+
+	if total < 0 || st.Offset < total {
+		writeUploadStatus(w, http.StatusOK, st)
+		return
+	}
+
+	// That was the last chunk
+	ct, err := s.finishUpload(r.Context(), id)
+	if err != nil {
+		s.writeChunkError(w, err)
+		return
+	}
+	st.Complete, st.ContentType, st.URL = true, ct, apiPrefix(r.Context())+"/video/"+id
+	writeUploadStatus(w, http.StatusCreated, st)
+}
+
+// handleDeleteUpload abandons an unfinished upload.
+func (s *server) handleDeleteUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.chunks.lock(id) {
+		writeError(w, http.StatusConflict, "upload_in_progress", "Another chunk is being written to this upload")
+		return
+	}
+	defer s.chunks.unlock(id)
+
+	if err := os.Remove(s.partialPath(id)); err != nil {
+		s.writeChunkError(w, err)
+		return
+	}
+	os.Remove(s.metaPath(id))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload checks the type of a fully received upload, the same way
+// saveUpload does, and moves it into storage. It returns the type the file
+// was accepted as.
+func (s *server) finishUpload(ctx context.Context, id string) (string, error) {
+	m, err := s.readUploadMeta(id)
+	if err != nil {
+		return "", err
+	}
+	head, err := readHead(s.partialPath(id))
+	if err != nil {
+		return "", err
+	}
+	ct := uploadType(head, m.ContentType)
+	if !uploadTypeAllowed(s.uploadTypes, ct) {
+		os.Remove(s.partialPath(id))
+		os.Remove(s.metaPath(id))
+		return "", errFileType
+	}
+
+	f, err := os.Open(s.partialPath(id))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	m.ContentType = ct
+	if err := s.writeUploadMeta(id, m); err != nil {
+		return "", err
+	}
+	if _, err := s.files.Put(ctx, mediaKey(id), f); err != nil {
+		return "", &storageError{err}
+	}
+	f.Close()
+	return ct, os.Remove(s.partialPath(id))
+}
+
+// sweepUploads removes unfinished uploads that haven't had a chunk for
+// ttl, every uploadSweep. It never returns.
+func (s *server) sweepUploads(ttl time.Duration) {
+	for range time.Tick(uploadSweep) {
+		s.removeStaleUploads(time.Now().Add(-ttl))
+	}
+}
+
+// removeStaleUploads removes the unfinished uploads last written to
+// before cutoff.
+func (s *server) removeStaleUploads(cutoff time.Time) {
+	entries, err := os.ReadDir(filepath.Join(s.uploadDir, partialDir))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("error looking for abandoned uploads: %v", err)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		id := e.Name()
+		info, err := e.Info()
+		if err != nil || !info.ModTime().Before(cutoff) || !s.chunks.lock(id) {
+			continue
+		}
+		if err := os.Remove(s.partialPath(id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("error removing abandoned upload %s: %v", id, err)
+		} else {
+			os.Remove(s.metaPath(id))
+		}
+		s.chunks.unlock(id)
+	}
+}
+
+// uploadStatus works out where an upload is at from its files. An upload
+// with neither a partial file nor a stored one doesn't exist.
+func (s *server) uploadStatus(ctx context.Context, id string) (uploadStatus, error) {
+	st := uploadStatus{ID: id}
+	info, err := os.Stat(s.partialPath(id))
+	if err == nil {
+		st.Offset = info.Size()
+		return st, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return st, err
+	}
+
+	stored, err := s.files.Stat(ctx, mediaKey(id))
+	if err != nil {
+		return st, &storageError{err}
+	}
+	m, err := s.readUploadMeta(id)
+	if err != nil {
+		return st, err
+	}
+	st.Offset, st.Complete, st.ContentType, st.URL = stored.Size, true, m.ContentType, apiPrefix(ctx)+"/video/"+id
+	return st, nil
+}
+
+func (s *server) readUploadMeta(id string) (uploadMeta, error) {
+	var m uploadMeta
+	data, err := os.ReadFile(s.metaPath(id))
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(data, &m)
+}
+
+func (s *server) writeUploadMeta(id string, m uploadMeta) error {
+	if err := os.MkdirAll(filepath.Join(s.uploadDir, metaDir), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.metaPath(id), data, 0o644)
+}
+
+// writeChunkError sends the response for an error from the /uploads
+// handlers. A missing file means there's no such upload.
+func (s *server) writeChunkError(w http.ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "not_found", "Upload not found")
+		return
+	}
+	s.writeUploadError(w, err)
+}
+
+func writeUploadStatus(w http.ResponseWriter, status int, st uploadStatus) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(st.Offset, 10))
+	writeJSON(w, status, st)
+}
+
+func (s *server) partialPath(id string) string {
+	return filepath.Join(s.uploadDir, partialDir, id)
+}
+
+func (s *server) metaPath(id string) string {
+	return filepath.Join(s.uploadDir, metaDir, id+".json")
+}
+
+// mediaKey is the storage key of a finished resumable upload.
+func mediaKey(id string) string {
+	return "media/" + id
+}
+
+// readHead reads the first 512 bytes of a file, all http.DetectContentType
+// looks at.
+func readHead(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	return head[:n], nil
+}
+
+// parseContentRange parses a chunk's "bytes start-end/total" header. The
+// total can be "*" while the client doesn't know it yet, which comes back
+// as -1.
+func parseContentRange(h string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(h, "bytes ")
+	if !ok {
+		return 0, 0, 0, errors.New(`Content-Range must look like "bytes start-end/total"`)
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	from, to, ok2 := strings.Cut(rng, "-")
+	if !ok || !ok2 {
+		return 0, 0, 0, errors.New(`Content-Range must look like "bytes start-end/total"`)
+	}
+
+	start, err1 := strconv.ParseInt(from, 10, 64)
+	end, err2 := strconv.ParseInt(to, 10, 64)
+	total = -1
+	var err3 error
+	if size != "*" {
+		total, err3 = strconv.ParseInt(size, 10, 64)
+	}
+	if err1 != nil || err2 != nil || err3 != nil || start < 0 || end < start || (total >= 0 && end >= total) {
+		return 0, 0, 0, errors.New("Content-Range is not a valid byte range")
+	}
+	return start, end, total, nil
+}
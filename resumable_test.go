@@ -0,0 +1,169 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// asSubject serves h as if every request had authenticated as sub.
+func asSubject(sub string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, withSubject(r, sub))
+	})
+}
+
+func startUpload(t *testing.T, h http.Handler, header ...string) string {
+	t.Helper()
+	rec := do(h, "POST", "/uploads", "", header...)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /uploads = %d %s", rec.Code, rec.Body)
+	}
+	return decode[uploadStatus](t, rec).ID
+}
+
+func TestResumableUpload(t *testing.T) {
+	h, _ := newUploadServer(t)
+	id := startUpload(t, h)
+
+	put := func(contentRange, chunk string) *httptest.ResponseRecorder {
+		return do(h, "PUT", "/uploads/"+id, chunk, "Content-Type", "application/octet-stream", "Content-Range", contentRange)
+	}
+	n := len(webm)
+	if rec := put("bytes 0-3/*", webm[:4]); rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "4" {
+		t.Fatalf("first chunk = %d %s, offset %s", rec.Code, rec.Body, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := put("bytes 0-3/*", webm[:4]); rec.Code != http.StatusConflict || rec.Header().Get("Upload-Offset") != "4" {
+		t.Errorf("repeated chunk = %d, offset %s, want 409 at 4", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if st := decode[uploadStatus](t, do(h, "GET", "/uploads/"+id, "")); st.Offset != 4 || st.Complete {
+		t.Errorf("status midway = %+v", st)
+	}
+
+	rec := put("bytes 4-"+strconv.Itoa(n-1)+"/"+strconv.Itoa(n), webm[4:])
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("last chunk = %d %s", rec.Code, rec.Body)
+	}
+	if st := decode[uploadStatus](t, rec); !st.Complete || st.ContentType != "video/webm" || st.Offset != int64(n) {
+		t.Errorf("finished status = %+v", st)
+	}
+	if rec := put("bytes 0-3/4", webm[:4]); rec.Code != http.StatusConflict {
+		t.Errorf("chunk after completion = %d, want 409", rec.Code)
+	}
+}
+
+func TestResumableUploadType(t *testing.T) {
+	h, _ := newUploadServer(t)
+	finish := func(contents string, header ...string) *httptest.ResponseRecorder {
+		id := startUpload(t, h, header...)
+		return do(h, "PUT", "/uploads/"+id, contents,
+			"Content-Type", "application/octet-stream",
+			"Content-Range", "bytes 0-"+strconv.Itoa(len(contents)-1)+"/"+strconv.Itoa(len(contents)))
+	}
+
+	// Like multipart uploads, the declared type only counts when sniffing
+	// can't tell, and it sticks once the upload is complete
+	rec := finish("\x01\x02\x03\x04", "X-Upload-Content-Type", "video/mp4")
+	st := decode[uploadStatus](t, rec)
+	if rec.Code != http.StatusCreated || st.ContentType != "video/mp4" {
+		t.Fatalf("unsniffable upload = %d %+v, want video/mp4", rec.Code, st)
+	}
+	if st := decode[uploadStatus](t, do(h, "GET", "/uploads/"+st.ID, "")); st.ContentType != "video/mp4" {
+		t.Errorf("status later says %q", st.ContentType)
+	}
+
+	if rec := finish("<html><script>alert(1)</script></html>", "X-Upload-Content-Type", "video/mp4"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("html declared as video = %d, want 415", rec.Code)
+	}
+	if rec := finish("\x01\x02\x03\x04", "X-Upload-Content-Type", "image/svg+xml"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("svg = %d, want 415", rec.Code)
+	}
+	if rec := finish("\x01\x02\x03\x04"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown type with nothing declared = %d, want 415", rec.Code)
+	}
+}
+
+func TestResumableUploadOwner(t *testing.T) {
+	base, _ := newUploadServer(t)
+	ann, bob := asSubject("ann", base), asSubject("bob", base)
+	id := startUpload(t, ann)
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		rec := do(bob, method, "/uploads/"+id, "x", "Content-Range", "bytes 0-0/*")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s by someone else = %d, want 404", method, rec.Code)
+		}
+	}
+	if rec := do(ann, "DELETE", "/uploads/"+id, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE by the owner = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(ann, "GET", "/uploads/"+id, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE = %d, want 404", rec.Code)
+	}
+}
+
+func TestRemoveStaleUploads(t *testing.T) {
+	var srv *server
+	h, dir := newUploadServer(t, func(s *server) { srv = s })
+	stale, fresh := startUpload(t, h), startUpload(t, h)
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, partialDir, stale), old, old); err != nil {
+		t.Fatal(err)
+	}
+	srv.removeStaleUploads(time.Now().Add(-time.Hour))
+
+	if rec := do(h, "GET", "/uploads/"+stale, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("stale upload = %d, want 404", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, metaDir, stale+".json")); !os.IsNotExist(err) {
+		t.Errorf("stale upload's meta file is still there: %v", err)
+	}
+	if rec := do(h, "GET", "/uploads/"+fresh, ""); rec.Code != http.StatusOK {
+		t.Errorf("fresh upload = %d, want 200", rec.Code)
+	}
+}
+
+func TestStreamVideo(t *testing.T) {
+	h, _ := newUploadServer(t)
+	id := startUpload(t, h)
+	rec := do(h, "PUT", "/uploads/"+id, webm,
+		"Content-Type", "application/octet-stream",
+		"Content-Range", "bytes 0-"+strconv.Itoa(len(webm)-1)+"/"+strconv.Itoa(len(webm)))
+	st := decode[uploadStatus](t, rec)
+	if st.URL != "/video/"+id {
+		t.Fatalf("finished upload URL = %q", st.URL)
+	}
+
+	rec = do(h, "GET", st.URL, "")
+	if rec.Code != http.StatusOK || rec.Body.String() != webm {
+		t.Fatalf("GET video = %d %q", rec.Code, rec.Body)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":            "video/webm",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+		"Content-Disposition":     "attachment",
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	rec = do(h, "GET", st.URL, "", "Range", "bytes=4-")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != webm[4:] {
+		t.Errorf("ranged GET = %d %q", rec.Code, rec.Body)
+	}
+	if rec := do(h, "GET", st.URL, "", "Range", "bytes=1000-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("GET past the end = %d, want 416", rec.Code)
+	}
+
+	// An unfinished upload isn't a video yet
+	if rec := do(h, "GET", "/video/"+startUpload(t, h), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET of unfinished upload = %d, want 404", rec.Code)
+	}
+}
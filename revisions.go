@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Revision is an earlier version of a post's body. Every update that
+// changes the body keeps the old one, up to the store's limit, so edits
+// can be audited and diffed.
+type Revision struct {
+	Body string `json:"body"`
+	// UpdatedAt is when this version was saved
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// addRevision appends rev to revs, dropping the oldest ones past max.
+func addRevision(revs []Revision, rev Revision, max int) []Revision {
+	revs = append(revs, rev)
+	if len(revs) > max {
+		revs = append([]Revision(nil), revs[len(revs)-max:]...)
+	}
+	return revs
+}
+
+// handleListRevisions lists the earlier versions of a post, oldest first.
+func (s *server) handleListRevisions(w http.ResponseWriter, r *http.Request, id string) {
+	if err := s.checkRead(r.Context(), id); err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	revs, err := s.store.ListRevisions(r.Context(), id)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, revs)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// routes registers the API on mux, each route wrapped by api. Patterns
+// name their method, requests for a path we serve with a method we don't
+// end up in the "/" fallback, which answers them with the route's Allow
+// list. The route names are what logs and metrics label requests with.
+func (s *server) routes(mux *http.ServeMux, api func(route string, h http.HandlerFunc) http.Handler) {
+	mux.Handle("GET /posts", api("/posts", s.handleGetPosts))
+	mux.Handle("POST /posts", api("/posts", byID(s.handlePostPost)))
+	if s.allowDeleteAll {
+		mux.Handle("DELETE /posts", api("/posts", s.handleDeleteAllPosts))
+	}
+	mux.Handle("POST /posts/bulk", api("/posts/bulk", s.handleBulkCreatePosts))
+	mux.Handle("POST /posts/import", api("/posts/import", s.handleImportCSV))
+	mux.Handle("POST /posts/delete", api("/posts/delete", s.handleBulkDeletePosts))
+	mux.Handle("GET /posts.csv", api("/posts.csv", s.handleExportCSV))
+	mux.Handle("GET /posts/count", api("/posts/count", s.handleCountPosts))
+	mux.Handle("GET /posts/recent", api("/posts/recent", s.handleRecentPosts))
+	mux.Handle("GET /posts/popular", api("/posts/popular", s.handlePopularPosts))
+	mux.Handle("GET /posts/events", api("/posts/events", s.handlePostEvents))
+	mux.Handle("GET /ws", api("/ws", s.handleWebSocket))
+
+	mux.Handle("/post/{$}", api("/post/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusBadRequest, "invalid_id", "Invalid post ID")
+	}))
+	// net/http drops the body of HEAD responses for us, so HEAD gets
+	// exactly the status and headers GET would
+	mux.Handle("GET /post/{id}", api("/post/", byID(s.handleGetPost)))
+	mux.Handle("POST /post/{id}", api("/post/", byID(s.handlePostPost)))
+	mux.Handle("PUT /post/{id}", api("/post/", byID(s.handlePutPost)))
+	mux.Handle("PATCH /post/{id}", api("/post/", byID(s.handlePatchPost)))
+	mux.Handle("DELETE /post/{id}", api("/post/", byID(s.handleDeletePost)))
+	mux.Handle("OPTIONS /post/{id}", api("/post/", func(w http.ResponseWriter, r *http.Request) {
+		// RFC 5789 says to advertise the patch formats we understand
+		w.Header().Set("Accept-Patch", "application/json, "+mergePatchType+", "+jsonPatchType)
+		handleOptions(w, append(allowedMethods(mux, r), "OPTIONS")...)
+	}))
+	mux.Handle(getPostSubPattern, api("/post/", func(w http.ResponseWriter, r *http.Request) {
+		if !servesGetSub(r.URL.Path) {
+			// /post/{id}/like, say, which only takes other methods
+			fallbackHandler(mux, w, r)
+			return
+		}
+		s.handleGetPostSub(w, r)
+	}))
+	mux.Handle("POST /post/{id}/restore", api("/post/", byID(s.handleRestorePost)))
+	mux.Handle("POST /post/{id}/comments", api("/post/", byID(s.handleAddComment)))
+	mux.Handle("POST /post/{id}/like", api("/post/", func(w http.ResponseWriter, r *http.Request) {
+		s.handleLikePost(w, r, r.PathValue("id"), 1)
+	}))
+	mux.Handle("DELETE /post/{id}/like", api("/post/", func(w http.ResponseWriter, r *http.Request) {
+		s.handleLikePost(w, r, r.PathValue("id"), -1)
+	}))
+
+	mux.Handle("POST /uploads", api("/uploads", s.handleStartUpload))
+	mux.Handle("GET /uploads/{id}", api("/uploads/", s.byUploadID(s.handleGetUpload)))
+	mux.Handle("PUT /uploads/{id}", api("/uploads/", s.byUploadID(s.handlePutChunk)))
+	mux.Handle("DELETE /uploads/{id}", api("/uploads/", s.byUploadID(s.handleDeleteUpload)))
+	mux.Handle("GET /video/{id}", api("/video/", s.videoHandler))
+
+	mux.Handle("GET /admin/backup", withAuthRequired(api("/admin/backup", s.backupHandler)))
+	mux.Handle("POST /admin/restore", withAuthRequired(api("/admin/restore", s.restoreHandler)))
+
+	mux.Handle("/", api("/", func(w http.ResponseWriter, r *http.Request) {
+		fallbackHandler(mux, w, r)
+	}))
+}
+
+// getPostSubPattern is every GET below a post. The mux won't take both
+// "GET /post/slug/{slug}" and "GET /post/{id}/comments" since a request
+// could match either, so handleGetPostSub tells them apart instead.
+const getPostSubPattern = "GET /post/{id}/{sub}"
+
+// servesGetSub reports whether handleGetPostSub has something for path.
+// IDs are UUIDs so there's no post with the ID "slug" to get in the way.
+func servesGetSub(path string) bool {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(path, "/post/"), "/")
+	return id == "slug" || sub == "comments" || sub == "revisions" || sub == "file"
+}
+
+// handleGetPostSub serves the requests getPostSubPattern matches.
+func (s *server) handleGetPostSub(w http.ResponseWriter, r *http.Request) {
+	id, sub := r.PathValue("id"), r.PathValue("sub")
+	switch {
+	case id == "slug":
+		s.handleGetPostBySlug(w, r, sub)
+	case sub == "comments":
+		s.handleListComments(w, r, id)
+	case sub == "revisions":
+		s.handleListRevisions(w, r, id)
+	case sub == "file":
+		s.handleGetPostFile(w, r, id)
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "Not found")
+	}
+}
+
+// byID passes the {id} wildcard of the route to h.
+func byID(h func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r, r.PathValue("id"))
+	}
+}
+
+// byUploadID is byID for the /uploads routes. The ID ends up in a file
+// name, so it has to look exactly like ours, and only whoever started the
+// upload, in the same tenant, gets past. Someone else's upload looks the
+// same as one that doesn't exist.
+func (s *server) byUploadID(h func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if u, err := uuid.Parse(id); err != nil || u.String() != id {
+			writeError(w, http.StatusNotFound, "not_found", "Upload not found")
+			return
+		}
+		m, err := s.readUploadMeta(id)
+		if err == nil && (m.Owner != subjectFrom(r.Context()) || m.Tenant != tenantFrom(r.Context())) {
+			err = fs.ErrNotExist
+		}
+		if err != nil {
+			s.writeChunkError(w, err)
+			return
+		}
+		h(w, r, id)
+	}
+}
+
+// fallbackHandler gets every request no pattern matches. If the path is
+// served with other methods that's an OPTIONS request to answer or a 405,
+// otherwise it's a 404. The mux would do all that too, but in plain text.
+func fallbackHandler(mux *http.ServeMux, w http.ResponseWriter, r *http.Request) {
+	allowed := allowedMethods(mux, r)
+	if len(allowed) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "Not found")
+		return
+	}
+	allowed = append(allowed, "OPTIONS")
+	if r.Method == "OPTIONS" {
+		handleOptions(w, allowed...)
+		return
+	}
+	methodNotAllowed(w, allowed...)
+}
+
+// probeMethods are the methods allowedMethods tries. OPTIONS is left out,
+// every path we serve answers it.
+var probeMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+
+// allowedMethods works out the methods r's path is served with by asking
+// mux which pattern would take the request with each of them.
+func allowedMethods(mux *http.ServeMux, r *http.Request) []string {
+	var allowed []string
+	probe := new(http.Request)
+	for _, m := range probeMethods {
+		*probe = *r
+		probe.Method = m
+		_, pattern := mux.Handler(probe)
+		if pattern == "/" || pattern == getPostSubPattern && !servesGetSub(r.URL.Path) {
+			continue
+		}
+		allowed = append(allowed, m)
+	}
+	return allowed
+}
@@ -0,0 +1,41 @@
+package main
+
+// server holds what the HTTP handlers need. Handlers are methods on it
+// rather than reaching for globals, so a server can be put together
+// around any Store, a memoryStore in tests for instance.
+type server struct {
+	store Store
+
+	// countViews makes GET /post/{id} bump the post's view count
+	countViews bool
+	// allowDeleteAll enables DELETE /posts, see handleDeleteAllPosts
+	allowDeleteAll bool
+	// privatePosts limits reads to the caller's own posts, see canRead
+	privatePosts bool
+	// idempotency remembers Idempotency-Key headers on creates, nil
+	// ignores them
+	idempotency *idempotencyKeys
+
+	// files is where uploaded files are kept. uploadDir holds unfinished
+	// resumable uploads. Files up to maxUpload bytes and of one of
+	// uploadTypes are accepted.
+	files       StorageBackend
+	uploadDir   string
+	maxUpload   int64
+	uploadTypes []string
+	// chunks stops two requests writing to one resumable upload at once
+	chunks uploadLocks
+
+	// audit records every change to posts, nil records nothing
+	audit *auditLog
+	// webhook is told about new posts, nil tells no one
+	webhook *webhook
+	// events passes changes to posts on to GET /posts/events
+	events *broadcaster
+	// origins are the ones allowed to open a WebSocket, see wsCheckOrigin
+	origins []string
+}
+
+func newServer(store Store) *server {
+	return &server{store: store, events: newBroadcaster()}
+}
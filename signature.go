@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errSignature is what reading a streamed body fails with when it turns
+// out not to match its X-Signature.
+var errSignature = errors.New("body doesn't match X-Signature")
+
+const bodySignedKey contextKey = "body_signed"
+
+// bodySigned reports whether the request body is checked against its
+// signature as it's read, see withSignature. A handler that reads such a
+// body has to read it to the end and can't keep anything it read unless
+// that succeeded.
+func bodySigned(ctx context.Context) bool {
+	signed, _ := ctx.Value(bodySignedKey).(bool)
+	return signed
+}
+
+// withSignature checks that writes come from someone who has secret. The
+// sender signs the body with HMAC-SHA256 and sends the hex digest in
+// X-Signature, "sha256=" in front of it optional. It's the body as sent
+// that's signed, before any Content-Encoding is undone, so this has to
+// wrap withGzipBody. Reads carry no body, so they aren't checked. With no
+// secret it does nothing.
+//
+// Bodies of up to limit bytes are read and checked before the handler
+// runs. Uploads, see isUpload, are too big to hold on to, so they're
+// checked as they stream past and reading the last of them fails with
+// errSignature if they don't match.
+func withSignature(secret []byte, limit int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		if len(secret) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isReadMethod(r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			got, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get("X-Signature"), "sha256="))
+			if err != nil || len(got) == 0 {
+				writeSignatureError(w)
+				return
+			}
+			mac := hmac.New(sha256.New, secret)
+
+			switch {
+			case r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0:
+				if !hmac.Equal(got, mac.Sum(nil)) {
+					writeSignatureError(w)
+					return
+				}
+			case isUpload(r):
+				r.Body = &signedBody{ReadCloser: r.Body, mac: mac, want: got}
+				r = r.WithContext(context.WithValue(r.Context(), bodySignedKey, true))
+			default:
+				// The handler still has to read the body, so it's put
+				// back once we're done with it
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+				body, ok := readBody(w, r)
+				if !ok {
+					return
+				}
+				mac.Write(body)
+				if !hmac.Equal(got, mac.Sum(nil)) {
+					writeSignatureError(w)
+					return
+				}
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeSignatureError(w http.ResponseWriter) {
+	writeError(w, http.StatusUnauthorized, "invalid_signature", "Missing or invalid X-Signature")
+}
+
+// signedBody hashes a body as it's read and fails the read that reaches
+// its end if the hash isn't want.
+type signedBody struct {
+	io.ReadCloser
+	mac  hash.Hash
+	want []byte
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mac.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(b.want, b.mac.Sum(nil)) {
+		err = errSignature
+	}
+	return n, err
+}
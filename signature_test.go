@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var testSecret = []byte("s3cret")
+
+func sign(body string) string {
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignature(t *testing.T) {
+	h := Chain(newTestServer(t), withSignature(testSecret, 1<<10), withGzipBody, withMaxBody(1<<10, 1<<10))
+	body := `{"title":"Signed","body":"b"}`
+
+	if rec := do(h, "POST", "/posts", body); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned POST = %d, want 401", rec.Code)
+	}
+	if rec := do(h, "POST", "/posts", body, "X-Signature", sign(body+" ")); rec.Code != http.StatusUnauthorized {
+		t.Errorf("POST with the wrong signature = %d, want 401", rec.Code)
+	}
+	rec := do(h, "POST", "/posts", body, "X-Signature", sign(body))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("signed POST = %d %s, want 201", rec.Code, rec.Body)
+	}
+	p := decode[Post](t, rec)
+	if rec := do(h, "GET", "/post/"+p.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("unsigned GET = %d, want 200", rec.Code)
+	}
+
+	// What's signed is the body as sent, compressed
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(body))
+	zw.Close()
+	gz := buf.String()
+	if rec := do(h, "POST", "/posts", gz, "Content-Encoding", "gzip", "X-Signature", sign(body)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("gzip POST signed uncompressed = %d, want 401", rec.Code)
+	}
+	if rec := do(h, "POST", "/posts", gz, "Content-Encoding", "gzip", "X-Signature", sign(gz)); rec.Code != http.StatusCreated {
+		t.Errorf("gzip POST signed as sent = %d %s, want 201", rec.Code, rec.Body)
+	}
+
+	big := `{"title":"Big","body":"` + string(bytes.Repeat([]byte("x"), 1<<10)) + `"}`
+	if rec := do(h, "POST", "/posts", big, "X-Signature", sign(big)); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("signed POST over the limit = %d, want 413", rec.Code)
+	}
+
+	if rec := do(h, "DELETE", "/post/"+p.ID, "", "X-Signature", sign("x")); rec.Code != http.StatusUnauthorized {
+		t.Errorf("DELETE with the wrong signature = %d, want 401", rec.Code)
+	}
+	if rec := do(h, "DELETE", "/post/"+p.ID, "", "X-Signature", sign("")); rec.Code != http.StatusOK {
+		t.Errorf("DELETE signed empty = %d %s, want 200", rec.Code, rec.Body)
+	}
+}
+
+func TestSignedUpload(t *testing.T) {
+	srv, dir := newUploadServer(t)
+	h := Chain(srv, withSignature(testSecret, 1<<10), withGzipBody, withMaxBody(1<<10, 1<<12))
+
+	// A multipart upload that doesn't match leaves no file behind
+	body, formType := multipartPost(t, `{"title":"Clip","body":"b"}`, "video/webm", webm)
+	if rec := do(h, "POST", "/posts", body, "Content-Type", formType, "X-Signature", sign(body+"x")); rec.Code != http.StatusUnauthorized {
+		t.Errorf("multipart POST with the wrong signature = %d %s, want 401", rec.Code, rec.Body)
+	}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			t.Errorf("%s left behind by a rejected upload", path)
+		}
+		return nil
+	})
+	if rec := do(h, "POST", "/posts", body, "Content-Type", formType, "X-Signature", sign(body)); rec.Code != http.StatusCreated {
+		t.Errorf("signed multipart POST = %d %s, want 201", rec.Code, rec.Body)
+	}
+
+	// Starting an upload has no body
+	id := startUpload(t, h, "X-Signature", sign(""))
+	put := func(sig string) int {
+		rng := "bytes 0-" + strconv.Itoa(len(webm)-1) + "/" + strconv.Itoa(len(webm))
+		return do(h, "PUT", "/uploads/"+id, webm, "Content-Range", rng, "X-Signature", sig).Code
+	}
+	if code := put(sign(webm[1:])); code != http.StatusUnauthorized {
+		t.Errorf("chunk with the wrong signature = %d, want 401", code)
+	}
+	if st := decode[uploadStatus](t, do(h, "GET", "/uploads/"+id, "")); st.Offset != 0 {
+		t.Errorf("offset after a rejected chunk = %d, want 0", st.Offset)
+	}
+	if code := put(sign(webm)); code != http.StatusCreated {
+		t.Errorf("signed chunk = %d, want 201", code)
+	}
+}
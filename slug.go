@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// maxSlugLength keeps slugs of long titles to a sensible URL length.
+const maxSlugLength = 80
+
+// slugify turns a title into a URL slug: lowercase ASCII letters and
+// digits with runs of anything else collapsed into single hyphens. Titles
+// with nothing usable in them get "post".
+func slugify(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+		if b.Len() >= maxSlugLength {
+			break
+		}
+	}
+
+	slug := strings.TrimRight(b.String(), "-")
+	if slug == "" {
+		return "post"
+	}
+	return slug
+}
+
+// uniqueSlug returns base, or base with the first numeric suffix ("-2",
+// "-3", ...) that taken says is free.
+func uniqueSlug(base string, taken func(slug string) (bool, error)) (string, error) {
+	slug := base
+	for n := 2; ; n++ {
+		t, err := taken(slug)
+		if err != nil || !t {
+			return slug, err
+		}
+		slug = base + "-" + strconv.Itoa(n)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// StorageBackend is where uploaded files live, attachments and finished
+// videos alike. The handlers only talk to this interface so files can be
+// kept on local disk or somewhere else without touching them. Keys are
+// slash separated paths the server makes up, never client input.
+//
+// Missing files are reported with an error matching fs.ErrNotExist.
+type StorageBackend interface {
+	// Put stores everything read from r under key, replacing whatever
+	// was there, and returns how many bytes it stored. If it fails
+	// nothing is left behind.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Get opens the file stored under key. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error)
+	// Delete removes the file stored under key.
+	Delete(ctx context.Context, key string) error
+	// Stat describes the file stored under key without opening it.
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+// ObjectInfo describes a stored file.
+type ObjectInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// openStorage creates the StorageBackend selected by kind. dir is where
+// the disk backend keeps its files, the S3 one is configured from the
+// environment, see newS3StorageFromEnv.
+func openStorage(kind, dir string) (StorageBackend, error) {
+	switch kind {
+	case "disk":
+		return newDiskStorage(dir), nil
+	case "s3":
+		return newS3StorageFromEnv()
+	default:
+		return nil, errors.New("unknown storage " + kind)
+	}
+}
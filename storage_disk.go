@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// diskStorage keeps files in a directory on the local file system, a key
+// is a path relative to it.
+type diskStorage struct {
+	dir string
+}
+
+func newDiskStorage(dir string) *diskStorage {
+	return &diskStorage{dir: dir}
+}
+
+func (d *diskStorage) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", errors.New("invalid storage key " + key)
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file next to the final one and renames it
+// into place, so a reader never sees half a file.
+func (d *diskStorage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".put-*")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return 0, err
+	}
+	return n, os.Rename(f.Name(), path)
+}
+
+func (d *diskStorage) Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return f, ObjectInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (d *diskStorage) Delete(ctx context.Context, key string) error {
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (d *diskStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is how much of a file s3Storage buffers before sending it as
+// one part of a multipart upload. S3 wants parts of at least 5 MiB.
+const s3PartSize = 8 << 20
+
+// s3Storage keeps files in a bucket of S3 or anything that speaks its API,
+// like MinIO. It talks plain HTTP with requests signed using AWS
+// Signature Version 4, which is all it needs.
+type s3Storage struct {
+	endpoint *url.URL
+	// pathStyle puts the bucket in the path rather than the host name,
+	// which is what most S3 compatible servers want
+	pathStyle bool
+	bucket    string
+	region    string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+// newS3StorageFromEnv configures an s3Storage from the environment.
+// S3_BUCKET is required. Without S3_ENDPOINT it talks to AWS in
+// S3_REGION, with it to that server using path style URLs. Credentials
+// come from the usual AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN.
+func newS3StorageFromEnv() (*s3Storage, error) {
+	s := &s3Storage{
+		bucket:       os.Getenv("S3_BUCKET"),
+		region:       envOr("S3_REGION", envOr("AWS_REGION", "us-east-1")),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if s.bucket == "" {
+		return nil, errors.New("S3_BUCKET must be set")
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	s.pathStyle = endpoint != ""
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3_ENDPOINT %q", endpoint)
+	}
+	return s, nil
+}
+
+// objectURL is the URL of key, with query added if it isn't empty.
+func (s *s3Storage) objectURL(key string, query url.Values) string {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Put streams r to the bucket. Anything that fits in one part goes up in
+// a single request, bigger files as a multipart upload, so memory use
+// stays at one part whatever the file's size.
+func (s *s3Storage) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	buf := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err := s.do(ctx, "PUT", key, nil, buf[:n], nil)
+		return int64(n), err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := s.startMultipart(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	size, err := s.putParts(ctx, key, id, r, buf)
+	if err != nil {
+		s.do(context.WithoutCancel(ctx), "DELETE", key, url.Values{"uploadId": {id}}, nil, nil)
+		return 0, err
+	}
+	return size, nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// putParts sends the already full buf and then the rest of r as parts of
+// the multipart upload id, and completes it.
+func (s *s3Storage) putParts(ctx context.Context, key, id string, r io.Reader, buf []byte) (int64, error) {
+	var parts []s3Part
+	var size int64
+	n := len(buf)
+	for {
+		q := url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {id}}
+		resp, err := s.do(ctx, "PUT", key, q, buf[:n], nil)
+		if err != nil {
+			return 0, err
+		}
+		parts = append(parts, s3Part{len(parts) + 1, resp.Header.Get("ETag")})
+		size += int64(n)
+
+		var rerr error
+		n, rerr = io.ReadFull(r, buf)
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil && rerr != io.ErrUnexpectedEOF {
+			return 0, rerr
+		}
+	}
+
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	resp, err := s.do(ctx, "POST", key, url.Values{"uploadId": {id}}, body, nil)
+	if err != nil {
+		return 0, err
+	}
+	// Completing can fail after a 200, the error is in the body then
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err := xml.Unmarshal(resp.body, &result); err == nil && result.XMLName.Local == "Error" {
+		return 0, fmt.Errorf("s3: completing upload: %s: %s", result.Code, result.Message)
+	}
+	return size, nil
+}
+
+func (s *s3Storage) startMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := s.do(ctx, "POST", key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.body, &result); err != nil || result.UploadID == "" {
+		return "", errors.New("s3: no upload ID in CreateMultipartUpload response")
+	}
+	return result.UploadID, nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return &s3Object{s: s, ctx: ctx, key: key, size: info.Size}, info, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, "DELETE", key, nil, nil, nil)
+	return err
+}
+
+func (s *s3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := s.do(ctx, "HEAD", key, nil, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// s3Object reads an object lazily. Seeking only moves the offset, the
+// next Read then fetches the object from there with a Range request. That
+// is what http.ServeContent needs to answer Range requests without
+// downloading the whole object.
+type s3Object struct {
+	s      *s3Storage
+	ctx    context.Context
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.offset)}}
+		resp, err := o.s.send(o.ctx, "GET", o.key, nil, nil, header)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: seek before start of object")
+	}
+	if offset != o.offset {
+		o.Close()
+		o.offset = offset
+	}
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// s3Response is a response whose body has been read already.
+type s3Response struct {
+	*http.Response
+	body []byte
+}
+
+// do sends a signed request and reads the whole response.
+func (s *s3Storage) do(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (*s3Response, error) {
+	resp, err := s.send(ctx, method, key, query, body, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Response{resp, b}, nil
+}
+
+// send sends a signed request and returns the response with its body
+// still to be read, or an error for anything but a 2xx. A 404 is
+// reported as fs.ErrNotExist.
+func (s *s3Storage) send(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("s3: %s %s: %w", method, key, fs.ErrNotExist)
+	}
+	var e struct {
+		Code    string
+		Message string
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(b, &e)
+	return nil, fmt.Errorf("s3: %s %s: %s %s: %s", method, key, resp.Status, e.Code, e.Message)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req. The
+// host, range and x-amz-* headers are signed along with the body's hash.
+func (s *s3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery encodes a query string the way SigV4 wants it: sorted,
+// with spaces as %20 rather than +.
+func canonicalQuery(q url.Values) string {
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
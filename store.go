@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrNotFound is returned by a Store when the requested post doesn't exist.
+var ErrNotFound = errors.New("post not found")
+
+// ErrIDTaken is returned by Create when the ID the client picked already
+// belongs to a post, a soft deleted one included.
+var ErrIDTaken = errors.New("post ID already taken")
+
+// ErrTooManyPosts is returned by Import when it's given more posts than
+// the store may hold.
+var ErrTooManyPosts = errors.New("more posts than the store may hold")
+
+// Store is where posts live. The handlers only talk to this interface so
+// the backing storage can be swapped without touching them.
+type Store interface {
+	// List returns every post, in no particular order.
+	List(ctx context.Context) ([]Post, error)
+	// Get returns the post with the given ID or ErrNotFound.
+	Get(ctx context.Context, id string) (Post, error)
+	// GetBySlug returns the post with the given slug or ErrNotFound.
+	GetBySlug(ctx context.Context, slug string) (Post, error)
+	// Create assigns the post a new UUID, unless it already has an ID,
+	// and a slug made from its title that no other post has, sets its
+	// other server controlled fields, saves it and returns it. An ID
+	// that's in use gives ErrIDTaken.
+	//
+	// With a limit on the number of posts, creating one when the store
+	// is full first evicts the oldest, by creation time and then ID. The
+	// eviction is permanent and takes the post's comments and revisions
+	// with it. Soft deleted posts still take up room, so they count too
+	// and are evicted like any other. The evicted posts are returned so
+	// the caller can audit them and delete their attachments.
+	Create(ctx context.Context, p Post) (created Post, evicted []Post, err error)
+	// CreateMany is Create for a batch of posts. Either all of them are
+	// saved or none are. The result is in the same order as ps. It makes
+	// room for all of its posts, a batch bigger than the limit still
+	// goes in whole.
+	CreateMany(ctx context.Context, ps []Post) (created []Post, evicted []Post, err error)
+	// Update loads the post with the given ID, lets fn modify it and
+	// saves the result, all as one atomic step. Server controlled fields
+	// can't be changed by fn and UpdatedAt is bumped. If the body changed
+	// the old one is kept as a Revision. If fn returns an error nothing
+	// is saved and the error is returned as is.
+	Update(ctx context.Context, id string, fn func(p *Post) error) (Post, error)
+	// ListRevisions returns the earlier versions of a live post, oldest
+	// first, or ErrNotFound if there's no such post. Only the newest few
+	// are kept, as many as the store was opened with.
+	ListRevisions(ctx context.Context, postID string) ([]Revision, error)
+	// AddView atomically adds one to the post's view count and returns
+	// the post. UpdatedAt is left alone, a view isn't an edit.
+	AddView(ctx context.Context, id string) (Post, error)
+	// AddLikes atomically adds delta to the post's likes, never going
+	// below zero, and returns the post. UpdatedAt is left alone.
+	AddLikes(ctx context.Context, id string, delta int64) (Post, error)
+	// ListComments returns the comments on a live post, oldest first, or
+	// ErrNotFound if there's no such post.
+	ListComments(ctx context.Context, postID string) ([]Comment, error)
+	// AddComment sets the comment's server controlled fields and adds it
+	// to a live post, or returns ErrNotFound if there's no such post.
+	AddComment(ctx context.Context, postID string, c Comment) (Comment, error)
+	// Delete soft deletes the post with the given ID or returns
+	// ErrNotFound. Deleted posts are hidden from every other method
+	// until they're restored. Their comments are dropped for good. If
+	// check isn't nil it's called with the post first, in the same
+	// atomic step, and an error from it stops the delete and is
+	// returned as is.
+	Delete(ctx context.Context, id string, check func(p Post) error) error
+	// DeleteMany soft deletes every post in ids in one pass, dropping
+	// their comments like Delete does. IDs that don't exist are skipped
+	// rather than failing the whole batch, the result says which ones
+	// were actually deleted.
+	DeleteMany(ctx context.Context, ids []string) (deleted []string, err error)
+	// Restore brings back a soft deleted post. Restoring a post that
+	// isn't deleted just returns it. check works like Delete's.
+	Restore(ctx context.Context, id string, check func(p Post) error) (Post, error)
+	// Export calls fn for every post, soft deleted ones included, from a
+	// consistent snapshot. Writes wait until it's done. It stops at the
+	// first error fn returns.
+	Export(ctx context.Context, fn func(p Post) error) error
+	// DeleteAll permanently removes every post, soft deleted ones too,
+	// and every comment and revision, and returns the posts it removed.
+	DeleteAll(ctx context.Context) ([]Post, error)
+	// Import replaces every stored post with ps in one atomic step. Unlike
+	// Create it keeps the IDs, timestamps and deleted state it's given,
+	// it's meant for restoring what Export wrote out. Comments on posts
+	// that don't survive as live posts are dropped, as are revisions of
+	// posts that aren't in ps. It returns the posts that were replaced.
+	// A backup that holds more posts than the limit gives
+	// ErrTooManyPosts and changes nothing.
+	Import(ctx context.Context, ps []Post) (replaced []Post, err error)
+	// DeleteExpired permanently removes every post that expired by now,
+	// comments and revisions included, and returns them so the caller can
+	// audit them and delete their attachments.
+	DeleteExpired(ctx context.Context, now time.Time) ([]Post, error)
+	// Ping reports whether the store is ready to serve requests.
+	Ping(ctx context.Context) error
+	// Close flushes anything pending and releases the store's resources.
+	Close() error
+}
+
+// expired reports whether p's time ran out by now.
+func (p Post) expired(now time.Time) bool {
+	return p.ExpiresAt != nil && !p.ExpiresAt.After(now)
+}
+
+// newPost fills in the server controlled fields of a post about to be
+// created, overwriting anything the client sent for them. The ID is the
+// exception, one the client picked is kept.
+func newPost(p Post) Post {
+	now := time.Now().UTC()
+	if p.ID == "" {
+		p.ID = uuid.NewString()
+	}
+	p.Slug = ""
+	p.Views, p.Likes = 0, 0
+	p.CreatedAt, p.UpdatedAt = now, now
+	p.Deleted, p.DeletedAt = false, nil
+	p.Tags = normalizeTags(p.Tags)
+	return p
+}
+
+// importPost tidies up a post being restored from a backup. Anything the
+// backup has is kept, missing timestamps are filled in.
+func importPost(p Post) Post {
+	now := time.Now().UTC()
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = now
+	}
+	if p.UpdatedAt.IsZero() {
+		p.UpdatedAt = p.CreatedAt
+	}
+	if p.DeletedAt != nil {
+		p.Deleted = true
+	} else if p.Deleted {
+		p.DeletedAt = &now
+	}
+	p.Tags = normalizeTags(p.Tags)
+	return p
+}
+
+// updatePost runs fn on a copy of old and returns the result, with the
+// fields clients aren't allowed to change put back and UpdatedAt bumped.
+// The author and slug are set once on creation and stick, so links to a
+// post keep working when its title changes.
+func updatePost(old Post, fn func(p *Post) error) (Post, error) {
+	p := old
+	if err := fn(&p); err != nil {
+		return Post{}, err
+	}
+	p.ID = old.ID
+	p.Slug = old.Slug
+	p.Views, p.Likes = old.Views, old.Likes
+	p.CreatedAt = old.CreatedAt
+	p.Author = old.Author
+	p.Owner = old.Owner
+	p.Attachment = old.Attachment
+	p.Deleted, p.DeletedAt = old.Deleted, old.DeletedAt
+	p.UpdatedAt = time.Now().UTC()
+	p.Tags = normalizeTags(p.Tags)
+	return p, nil
+}
+
+// normalizeTags trims and lowercases tags and drops empty and repeated
+// ones, so filtering by tag doesn't depend on how the client typed it.
+func normalizeTags(tags []string) []string {
+	var out []string
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" && !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// openStore creates the Store selected by kind. An empty path picks a
+// sensible default file name for that kind. maxRevisions is how many
+// earlier versions of each post are kept, maxPosts how many posts, 0 for
+// no limit.
+func openStore(kind, path string, maxRevisions, maxPosts int) (Store, error) {
+	switch kind {
+	case "sqlite":
+		return newSQLiteStore(storePath(kind, path), maxRevisions, maxPosts)
+	case "json":
+		return newMemoryStore(storePath(kind, path), maxRevisions, maxPosts)
+	case "memory":
+		return newMemoryStore("", maxRevisions, maxPosts)
+	default:
+		return nil, errors.New("unknown store " + kind)
+	}
+}
+
+// storePath is path, or the default data file for kind if path is empty.
+func storePath(kind, path string) string {
+	if path != "" {
+		return path
+	}
+	switch kind {
+	case "sqlite":
+		return "posts.db"
+	case "json":
+		return "posts.json"
+	}
+	return ""
+}
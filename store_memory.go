@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps posts in a map, guarded by a read/write lock so
+// concurrent reads don't queue up behind each other. When path is set the
+// maps are also written to that JSON file after every mutation and loaded
+// back on startup, otherwise everything is lost on restart (handy for
+// tests).
+type memoryStore struct {
+	mu    sync.RWMutex
+	posts map[string]Post
+	// slugs maps every slug in posts, deleted posts' too, to its post ID
+	slugs map[string]string
+	// comments holds each post's comments, oldest first, keyed by post
+	// ID. It's under the same lock as posts so deleting a post and its
+	// comments is one step.
+	comments map[string][]Comment
+	// revisions holds each post's earlier bodies, oldest first, at most
+	// maxRevisions of them
+	revisions    map[string][]Revision
+	maxRevisions int
+	// maxPosts is how many posts are kept, 0 for no limit
+	maxPosts int
+	path     string
+}
+
+// memoryData is the layout of the data file.
+type memoryData struct {
+	Posts     []Post                `json:"posts"`
+	Comments  map[string][]Comment  `json:"comments,omitempty"`
+	Revisions map[string][]Revision `json:"revisions,omitempty"`
+}
+
+func newMemoryStore(path string, maxRevisions, maxPosts int) (*memoryStore, error) {
+	s := &memoryStore{
+		posts:        make(map[string]Post),
+		slugs:        make(map[string]string),
+		comments:     make(map[string][]Comment),
+		revisions:    make(map[string][]Revision),
+		maxRevisions: maxRevisions,
+		maxPosts:     maxPosts,
+		path:         path,
+	}
+	if path != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ps := make([]Post, 0, len(s.posts))
+	for _, p := range s.posts {
+		if !p.Deleted {
+			ps = append(ps, p)
+		}
+	}
+	return ps, nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.posts[id]
+	if !ok || p.Deleted {
+		return Post{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryStore) GetBySlug(ctx context.Context, slug string) (Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.posts[s.slugs[slug]]
+	if !ok || p.Deleted {
+		return Post{}, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryStore) Create(ctx context.Context, p Post) (Post, []Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, taken := s.posts[p.ID]; taken && p.ID != "" {
+		return Post{}, nil, ErrIDTaken
+	}
+	evicted := s.makeRoom(1)
+	p = newPost(p)
+	s.assignSlug(&p)
+	s.posts[p.ID] = p
+	s.persist()
+	return p, evicted, nil
+}
+
+func (s *memoryStore) CreateMany(ctx context.Context, ps []Post) ([]Post, []Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	evicted := s.makeRoom(len(ps))
+	created := make([]Post, len(ps))
+	for i, p := range ps {
+		p = newPost(p)
+		s.assignSlug(&p)
+		s.posts[p.ID] = p
+		created[i] = p
+	}
+	s.persist()
+	return created, evicted, nil
+}
+
+// makeRoom evicts the oldest posts until n more fit under maxPosts and
+// returns them. The caller holds the write lock.
+func (s *memoryStore) makeRoom(n int) []Post {
+	excess := len(s.posts) + n - s.maxPosts
+	if s.maxPosts <= 0 || excess <= 0 {
+		return nil
+	}
+	oldest := make([]Post, 0, len(s.posts))
+	for _, p := range s.posts {
+		oldest = append(oldest, p)
+	}
+	slices.SortFunc(oldest, func(a, b Post) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	evicted := oldest[:min(excess, len(oldest))]
+	s.remove(evicted)
+	return evicted
+}
+
+// remove drops ps for good, with their comments, revisions and slugs. The
+// caller holds the write lock.
+func (s *memoryStore) remove(ps []Post) {
+	for _, p := range ps {
+		delete(s.posts, p.ID)
+		delete(s.comments, p.ID)
+		delete(s.revisions, p.ID)
+	}
+	for slug, id := range s.slugs {
+		if _, ok := s.posts[id]; !ok {
+			delete(s.slugs, slug)
+		}
+	}
+}
+
+func (s *memoryStore) Update(ctx context.Context, id string, fn func(p *Post) error) (Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.posts[id]
+	if !ok || old.Deleted {
+		return Post{}, ErrNotFound
+	}
+	p, err := updatePost(old, fn)
+	if err != nil {
+		return Post{}, err
+	}
+	if p.Body != old.Body && s.maxRevisions > 0 {
+		s.revisions[id] = addRevision(s.revisions[id], Revision{Body: old.Body, UpdatedAt: old.UpdatedAt}, s.maxRevisions)
+	}
+	s.posts[id] = p
+	s.persist()
+	return p, nil
+}
+
+func (s *memoryStore) ListRevisions(ctx context.Context, postID string) ([]Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if p, ok := s.posts[postID]; !ok || p.Deleted {
+		return nil, ErrNotFound
+	}
+	return append([]Revision{}, s.revisions[postID]...), nil
+}
+
+func (s *memoryStore) AddView(ctx context.Context, id string) (Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.posts[id]
+	if !ok || p.Deleted {
+		return Post{}, ErrNotFound
+	}
+	p.Views++
+	s.posts[id] = p
+	// Not saving here, rewriting the whole file on every read would be
+	// far too slow. The count goes out with the next write or on Close.
+	return p, nil
+}
+
+func (s *memoryStore) AddLikes(ctx context.Context, id string, delta int64) (Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.posts[id]
+	if !ok || p.Deleted {
+		return Post{}, ErrNotFound
+	}
+	p.Likes = max(p.Likes+delta, 0)
+	s.posts[id] = p
+	s.persist()
+	return p, nil
+}
+
+func (s *memoryStore) ListComments(ctx context.Context, postID string) ([]Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if p, ok := s.posts[postID]; !ok || p.Deleted {
+		return nil, ErrNotFound
+	}
+	return append([]Comment{}, s.comments[postID]...), nil
+}
+
+func (s *memoryStore) AddComment(ctx context.Context, postID string, c Comment) (Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.posts[postID]; !ok || p.Deleted {
+		return Comment{}, ErrNotFound
+	}
+	c = newComment(postID, c)
+	s.comments[postID] = append(s.comments[postID], c)
+	s.persist()
+	return c, nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string, check func(p Post) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.posts[id]
+	if !ok || p.Deleted {
+		return ErrNotFound
+	}
+	if check != nil {
+		if err := check(p); err != nil {
+			return err
+		}
+	}
+
+	// Deleted posts stay in the map (and the data file) so they can be
+	// restored later
+	now := time.Now().UTC()
+	p.Deleted, p.DeletedAt = true, &now
+	s.posts[id] = p
+	delete(s.comments, id)
+	s.persist()
+	return nil
+}
+
+func (s *memoryStore) DeleteMany(ctx context.Context, ids []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	deleted := []string{}
+	for _, id := range ids {
+		p, ok := s.posts[id]
+		if !ok || p.Deleted {
+			continue
+		}
+		p.Deleted, p.DeletedAt = true, &now
+		s.posts[id] = p
+		delete(s.comments, id)
+		deleted = append(deleted, id)
+	}
+	if len(deleted) > 0 {
+		s.persist()
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) Restore(ctx context.Context, id string, check func(p Post) error) (Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.posts[id]
+	if !ok {
+		return Post{}, ErrNotFound
+	}
+	if check != nil {
+		if err := check(p); err != nil {
+			return Post{}, err
+		}
+	}
+	if !p.Deleted {
+		return p, nil
+	}
+
+	p.Deleted, p.DeletedAt = false, nil
+	p.UpdatedAt = time.Now().UTC()
+	s.posts[id] = p
+	s.persist()
+	return p, nil
+}
+
+func (s *memoryStore) Export(ctx context.Context, fn func(p Post) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Go in ID order so two backups of the same data are identical
+	ids := make([]string, 0, len(s.posts))
+	for id := range s.posts {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		if err := fn(s.posts[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteAll(ctx context.Context) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := make([]Post, 0, len(s.posts))
+	for _, p := range s.posts {
+		removed = append(removed, p)
+	}
+	s.posts = make(map[string]Post)
+	s.slugs = make(map[string]string)
+	s.comments = make(map[string][]Comment)
+	s.revisions = make(map[string][]Revision)
+	s.persist()
+	return removed, nil
+}
+
+func (s *memoryStore) DeleteExpired(ctx context.Context, now time.Time) ([]Post, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []Post
+	for _, p := range s.posts {
+		if p.expired(now) {
+			expired = append(expired, p)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+	s.remove(expired)
+	s.persist()
+	return expired, nil
+}
+
+func (s *memoryStore) Import(ctx context.Context, ps []Post) ([]Post, error) {
+	if s.maxPosts > 0 && len(ps) > s.maxPosts {
+		return nil, ErrTooManyPosts
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	posts := make(map[string]Post, len(ps))
+	comments := make(map[string][]Comment)
+	revisions := make(map[string][]Revision)
+	for _, p := range ps {
+		p = importPost(p)
+		posts[p.ID] = p
+		if cs, ok := s.comments[p.ID]; ok && !p.Deleted {
+			comments[p.ID] = cs
+		}
+		if revs, ok := s.revisions[p.ID]; ok {
+			revisions[p.ID] = revs
+		}
+	}
+
+	// Unlike the other mutations a failed save is reported, and the old
+	// posts put back, since the caller is counting on this reaching disk
+	oldPosts, oldComments, oldRevisions := s.posts, s.comments, s.revisions
+	s.posts, s.comments, s.revisions = posts, comments, revisions
+	if s.path != "" {
+		if err := s.save(); err != nil {
+			s.posts, s.comments, s.revisions = oldPosts, oldComments, oldRevisions
+			return nil, err
+		}
+	}
+	s.reindex()
+
+	replaced := make([]Post, 0, len(oldPosts))
+	for _, p := range oldPosts {
+		replaced = append(replaced, p)
+	}
+	return replaced, nil
+}
+
+// Ping always succeeds, the data file (if any) is loaded before the store is
+// handed out.
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close writes the posts to disk one last time. Every mutation already
+// saves, but this catches anything a failed save left behind.
+func (s *memoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path == "" {
+		return nil
+	}
+	return s.save()
+}
+
+// load reads the posts, comments and revisions saved at s.path. A missing
+// file isn't an error, it just means we're starting fresh.
+func (s *memoryStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Files from before comments existed are a bare array of posts. The
+	// posts are decoded as storedPost so old integer IDs still load.
+	var d struct {
+		Posts     []storedPost          `json:"posts"`
+		Comments  map[string][]Comment  `json:"comments"`
+		Revisions map[string][]Revision `json:"revisions"`
+	}
+	if len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &d.Posts)
+	} else {
+		err = json.Unmarshal(data, &d)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sp := range d.Posts {
+		p := sp.Post
+		p.ID = string(sp.ID)
+		s.posts[p.ID] = p
+	}
+	for id, cs := range d.Comments {
+		s.comments[id] = cs
+	}
+	for id, revs := range d.Revisions {
+		s.revisions[id] = revs
+	}
+	s.reindex()
+	return nil
+}
+
+// storedPost is a post as read back from the JSON file. Files written
+// before IDs became UUIDs have integer IDs, those are loaded as their
+// text form, the same way the SQLite migration converts them.
+type storedPost struct {
+	Post
+	ID storedID `json:"id"`
+}
+
+type storedID string
+
+func (id *storedID) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] != '"' {
+		var n json.Number
+		if err := json.Unmarshal(b, &n); err != nil {
+			return err
+		}
+		*id = storedID(n.String())
+		return nil
+	}
+	return json.Unmarshal(b, (*string)(id))
+}
+
+// assignSlug gives p a slug made from its title that isn't taken yet and
+// records it.
+//
+// Callers must hold s.mu.
+func (s *memoryStore) assignSlug(p *Post) {
+	p.Slug, _ = uniqueSlug(slugify(p.Title), func(slug string) (bool, error) {
+		_, taken := s.slugs[slug]
+		return taken, nil
+	})
+	s.slugs[p.Slug] = p.ID
+}
+
+// reindex rebuilds s.slugs after s.posts has been replaced wholesale.
+//
+// Callers must hold s.mu.
+func (s *memoryStore) reindex() {
+	s.slugs = make(map[string]string, len(s.posts))
+	for _, p := range s.posts {
+		if p.Slug != "" {
+			s.slugs[p.Slug] = p.ID
+		}
+	}
+}
+
+// save writes the posts, comments and revisions to s.path. It writes to a
+// temp file in the same directory first, fsyncs it and renames it over the
+// real one, so a crash or power loss half way through can't leave a
+// truncated file behind.
+//
+// Callers must hold s.mu.
+func (s *memoryStore) save() error {
+	d := memoryData{Posts: make([]Post, 0, len(s.posts)), Comments: s.comments, Revisions: s.revisions}
+	for _, p := range s.posts {
+		d.Posts = append(d.Posts, p)
+	}
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once the rename has happened
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Without this the rename can reach the disk before the data does
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.path))
+}
+
+// syncDir fsyncs a directory so a rename inside it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// persist saves the maps and logs any failure. The mutation has
+// already happened in memory so there's nothing to roll back.
+//
+// Callers must hold s.mu.
+func (s *memoryStore) persist() {
+	if s.path == "" {
+		return
+	}
+	if err := s.save(); err != nil {
+		logger.Println("error saving posts:", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// exclusiveStore is how the memory store used to lock, before reads took
+// a read lock: every call, reads included, waits for every other one.
+type exclusiveStore struct {
+	mu sync.Mutex
+	s  *memoryStore
+}
+
+func (e *exclusiveStore) List(ctx context.Context) ([]Post, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.s.List(ctx)
+}
+
+func (e *exclusiveStore) Get(ctx context.Context, id string) (Post, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.s.Get(ctx, id)
+}
+
+func (e *exclusiveStore) Update(ctx context.Context, id string, fn func(p *Post) error) (Post, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.s.Update(ctx, id, fn)
+}
+
+// benchStore is the part of Store the benchmark uses.
+type benchStore interface {
+	List(ctx context.Context) ([]Post, error)
+	Get(ctx context.Context, id string) (Post, error)
+	Update(ctx context.Context, id string, fn func(p *Post) error) (Post, error)
+}
+
+// BenchmarkMemoryStoreReads lists and gets posts from many goroutines
+// while one call in every 16 is an update. Compare the Mutex and RWMutex
+// results with -cpu 1,4,8: reads only scale with the read lock.
+func BenchmarkMemoryStoreReads(b *testing.B) {
+	ctx := context.Background()
+	newStore := func(b *testing.B) (*memoryStore, []string) {
+		s, err := newMemoryStore("", 10, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ids := make([]string, 100)
+		for i := range ids {
+			p, _, err := s.Create(ctx, Post{Body: "Post " + strconv.Itoa(i)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			ids[i] = p.ID
+		}
+		return s, ids
+	}
+
+	run := func(b *testing.B, store benchStore, ids []string) {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				id := ids[i%len(ids)]
+				var err error
+				switch {
+				case i%16 == 0:
+					_, err = store.Update(ctx, id, func(p *Post) error {
+						p.Body = "body " + strconv.Itoa(i)
+						return nil
+					})
+				case i%2 == 0:
+					_, err = store.List(ctx)
+				default:
+					_, err = store.Get(ctx, id)
+				}
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	}
+
+	b.Run("Mutex", func(b *testing.B) {
+		s, ids := newStore(b)
+		run(b, &exclusiveStore{s: s}, ids)
+	})
+	b.Run("RWMutex", func(b *testing.B) {
+		s, ids := newStore(b)
+		run(b, s, ids)
+	})
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteMigrations are applied in order on startup. The index of the last
+// applied one is kept in the database's user_version, so only append to
+// this list, never edit an entry that has shipped.
+var sqliteMigrations = []string{
+	`CREATE TABLE posts (
+		id   INTEGER PRIMARY KEY AUTOINCREMENT,
+		body TEXT NOT NULL
+	)`,
+	`ALTER TABLE posts ADD COLUMN created_at TEXT NOT NULL DEFAULT '';
+	ALTER TABLE posts ADD COLUMN updated_at TEXT NOT NULL DEFAULT '';
+	UPDATE posts SET
+		created_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now'),
+		updated_at = strftime('%Y-%m-%dT%H:%M:%SZ', 'now')`,
+	// IDs became UUIDs. SQLite can't change a column's type in place so
+	// the table is rebuilt, old integer IDs are kept as their text form.
+	`CREATE TABLE posts_new (
+		id         TEXT PRIMARY KEY,
+		body       TEXT NOT NULL,
+		created_at TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);
+	INSERT INTO posts_new SELECT CAST(id AS TEXT), body, created_at, updated_at FROM posts;
+	DROP TABLE posts;
+	ALTER TABLE posts_new RENAME TO posts`,
+	`ALTER TABLE posts ADD COLUMN deleted_at TEXT`,
+	// Tags are a JSON array, they're only ever filtered in Go
+	`ALTER TABLE posts ADD COLUMN tags TEXT NOT NULL DEFAULT '[]'`,
+	`ALTER TABLE posts ADD COLUMN author TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE posts ADD COLUMN title TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE posts ADD COLUMN slug TEXT NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX posts_slug ON posts (slug) WHERE slug != '';`,
+	`ALTER TABLE posts ADD COLUMN views INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE posts ADD COLUMN likes INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE comments (
+		id TEXT PRIMARY KEY,
+		post_id TEXT NOT NULL,
+		author TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL,
+		created_at TEXT NOT NULL
+	);
+	CREATE INDEX comments_post_id ON comments (post_id, created_at);`,
+	// JSON like tags, NULL when the post has no attachment
+	`ALTER TABLE posts ADD COLUMN attachment TEXT`,
+	`CREATE TABLE revisions (
+		post_id TEXT NOT NULL,
+		body TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	);
+	CREATE INDEX revisions_post_id ON revisions (post_id);`,
+	`ALTER TABLE posts ADD COLUMN owner TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE posts ADD COLUMN expires_at TEXT`,
+}
+
+// postColumns lists the columns scanPost expects, in order.
+const postColumns = `id, title, slug, body, author, owner, tags, views, likes, attachment, created_at, updated_at, deleted_at, expires_at`
+
+// sqliteStore keeps posts in a SQLite database file.
+type sqliteStore struct {
+	db *sql.DB
+	// maxRevisions is how many earlier bodies are kept per post
+	maxRevisions int
+	// maxPosts is how many posts are kept, 0 for no limit
+	maxPosts int
+}
+
+func newSQLiteStore(path string, maxRevisions, maxPosts int) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows one writer at a time, a single connection saves
+	// us from "database is locked" errors under concurrent requests.
+	db.SetMaxOpenConns(1)
+
+	s := &sqliteStore{db: db, maxRevisions: maxRevisions, maxPosts: maxPosts}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) migrate() error {
+	var version int
+	if err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		if err := s.migrateStep(i); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// migrateStep applies migration i and bumps user_version in the same
+// transaction, so a failure half way leaves neither behind and the step
+// is simply retried on the next start.
+func (s *sqliteStore) migrateStep(i int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no-op after a successful commit
+
+	if _, err := tx.Exec(sqliteMigrations[i]); err != nil {
+		return err
+	}
+	// PRAGMA doesn't take bind parameters
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) List(ctx context.Context) ([]Post, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+postColumns+` FROM posts WHERE deleted_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ps := []Post{}
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, rows.Err()
+}
+
+// Export reads everything with a single query, which SQLite runs against
+// one snapshot of the database.
+func (s *sqliteStore) Export(ctx context.Context, fn func(p Post) error) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+postColumns+` FROM posts ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) DeleteAll(ctx context.Context) ([]Post, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM comments`); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM revisions`); err != nil {
+		return nil, err
+	}
+	removed, err := deletePosts(ctx, tx, "")
+	if err != nil {
+		return nil, err
+	}
+	return removed, tx.Commit()
+}
+
+func (s *sqliteStore) ListComments(ctx context.Context, postID string) ([]Comment, error) {
+	if _, err := getPost(ctx, s.db, postID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, post_id, author, body, created_at FROM comments WHERE post_id = ? ORDER BY created_at, id`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cs := []Comment{}
+	for rows.Next() {
+		var c Comment
+		var created string
+		if err := rows.Scan(&c.ID, &c.PostID, &c.Author, &c.Body, &created); err != nil {
+			return nil, err
+		}
+		if c.CreatedAt, err = parseTime(created); err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+func (s *sqliteStore) AddComment(ctx context.Context, postID string, c Comment) (Comment, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Comment{}, err
+	}
+	defer tx.Rollback()
+
+	if _, err := getPost(ctx, tx, postID); err != nil {
+		return Comment{}, err
+	}
+	c = newComment(postID, c)
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO comments (id, post_id, author, body, created_at) VALUES (?, ?, ?, ?, ?)`,
+		c.ID, c.PostID, c.Author, c.Body, formatTime(c.CreatedAt)); err != nil {
+		return Comment{}, err
+	}
+	return c, tx.Commit()
+}
+
+// DeleteExpired compares expires_at as a time, like makeRoom does.
+func (s *sqliteStore) DeleteExpired(ctx context.Context, now time.Time) ([]Post, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const expired = `SELECT id FROM posts WHERE julianday(expires_at) <= julianday(?)`
+	at := formatTime(now)
+	for _, table := range []string{"comments", "revisions"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE post_id IN (`+expired+`)`, at); err != nil {
+			return nil, err
+		}
+	}
+	ps, err := deletePosts(ctx, tx, `WHERE id IN (`+expired+`)`, at)
+	if err != nil {
+		return nil, err
+	}
+	return ps, tx.Commit()
+}
+
+func (s *sqliteStore) Import(ctx context.Context, ps []Post) ([]Post, error) {
+	if s.maxPosts > 0 && len(ps) > s.maxPosts {
+		return nil, ErrTooManyPosts
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	replaced, err := deletePosts(ctx, tx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range ps {
+		if err := insertPost(ctx, tx, importPost(p)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM comments WHERE post_id NOT IN (SELECT id FROM posts WHERE deleted_at IS NULL)`); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`DELETE FROM revisions WHERE post_id NOT IN (SELECT id FROM posts)`); err != nil {
+		return nil, err
+	}
+	return replaced, tx.Commit()
+}
+
+func (s *sqliteStore) Get(ctx context.Context, id string) (Post, error) {
+	return getPost(ctx, s.db, id)
+}
+
+func (s *sqliteStore) GetBySlug(ctx context.Context, slug string) (Post, error) {
+	p, err := scanPost(s.db.QueryRowContext(ctx,
+		`SELECT `+postColumns+` FROM posts WHERE slug = ? AND deleted_at IS NULL`, slug))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Post{}, ErrNotFound
+	}
+	return p, err
+}
+
+func (s *sqliteStore) Create(ctx context.Context, p Post) (Post, []Post, error) {
+	// Checking the ID, picking the slug and inserting have to happen
+	// together, or two posts with the same title could both get it
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Post{}, nil, err
+	}
+	defer tx.Rollback()
+
+	if p.ID != "" {
+		var taken bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM posts WHERE id = ?)`, p.ID).Scan(&taken); err != nil {
+			return Post{}, nil, err
+		}
+		if taken {
+			return Post{}, nil, ErrIDTaken
+		}
+	}
+	evicted, err := s.makeRoom(ctx, tx, 1)
+	if err != nil {
+		return Post{}, nil, err
+	}
+
+	p = newPost(p)
+	if err := assignSlug(ctx, tx, &p); err != nil {
+		return Post{}, nil, err
+	}
+	if err := insertPost(ctx, tx, p); err != nil {
+		return Post{}, nil, err
+	}
+	return p, evicted, tx.Commit()
+}
+
+func (s *sqliteStore) CreateMany(ctx context.Context, ps []Post) ([]Post, []Post, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	evicted, err := s.makeRoom(ctx, tx, len(ps))
+	if err != nil {
+		return nil, nil, err
+	}
+	created := make([]Post, len(ps))
+	for i, p := range ps {
+		p = newPost(p)
+		if err := assignSlug(ctx, tx, &p); err != nil {
+			return nil, nil, err
+		}
+		if err := insertPost(ctx, tx, p); err != nil {
+			return nil, nil, err
+		}
+		created[i] = p
+	}
+	return created, evicted, tx.Commit()
+}
+
+// makeRoom evicts the oldest posts until n more fit under maxPosts and
+// returns them. created_at is compared as a time, not as text, since
+// RFC 3339 drops trailing zeros of the fraction.
+func (s *sqliteStore) makeRoom(ctx context.Context, tx *sql.Tx, n int) ([]Post, error) {
+	if s.maxPosts <= 0 {
+		return nil, nil
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM posts`).Scan(&count); err != nil {
+		return nil, err
+	}
+	excess := count + n - s.maxPosts
+	if excess <= 0 {
+		return nil, nil
+	}
+
+	const oldest = `SELECT id FROM posts ORDER BY julianday(created_at), id LIMIT ?`
+	for _, table := range []string{"comments", "revisions"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE post_id IN (`+oldest+`)`, excess); err != nil {
+			return nil, err
+		}
+	}
+	return deletePosts(ctx, tx, `WHERE id IN (`+oldest+`)`, excess)
+}
+
+func (s *sqliteStore) Update(ctx context.Context, id string, fn func(p *Post) error) (Post, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Post{}, err
+	}
+	defer tx.Rollback() // no-op after a successful commit
+
+	old, err := getPost(ctx, tx, id)
+	if err != nil {
+		return Post{}, err
+	}
+	p, err := updatePost(old, fn)
+	if err != nil {
+		return Post{}, err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE posts SET title = ?, body = ?, tags = ?, expires_at = ?, updated_at = ? WHERE id = ?`,
+		p.Title, p.Body, formatTags(p.Tags), formatNullTime(p.ExpiresAt), formatTime(p.UpdatedAt), p.ID); err != nil {
+		return Post{}, err
+	}
+	if p.Body != old.Body && s.maxRevisions > 0 {
+		if err := s.addRevision(ctx, tx, id, Revision{Body: old.Body, UpdatedAt: old.UpdatedAt}); err != nil {
+			return Post{}, err
+		}
+	}
+	return p, tx.Commit()
+}
+
+// addRevision stores rev and drops the post's oldest revisions past
+// s.maxRevisions. Rowids only go up, so they give the order the revisions
+// were added in.
+func (s *sqliteStore) addRevision(ctx context.Context, tx *sql.Tx, postID string, rev Revision) error {
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO revisions (post_id, body, updated_at) VALUES (?, ?, ?)`,
+		postID, rev.Body, formatTime(rev.UpdatedAt)); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		`DELETE FROM revisions WHERE post_id = ? AND rowid NOT IN (
+			SELECT rowid FROM revisions WHERE post_id = ? ORDER BY rowid DESC LIMIT ?
+		)`, postID, postID, s.maxRevisions)
+	return err
+}
+
+func (s *sqliteStore) ListRevisions(ctx context.Context, postID string) ([]Revision, error) {
+	if _, err := getPost(ctx, s.db, postID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT body, updated_at FROM revisions WHERE post_id = ? ORDER BY rowid`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := []Revision{}
+	for rows.Next() {
+		var rev Revision
+		var updated string
+		if err := rows.Scan(&rev.Body, &updated); err != nil {
+			return nil, err
+		}
+		if rev.UpdatedAt, err = parseTime(updated); err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+func (s *sqliteStore) AddView(ctx context.Context, id string) (Post, error) {
+	return s.addToCounter(ctx, id, `views = views + 1`)
+}
+
+func (s *sqliteStore) AddLikes(ctx context.Context, id string, delta int64) (Post, error) {
+	return s.addToCounter(ctx, id, `likes = max(likes + ?, 0)`, delta)
+}
+
+// addToCounter runs an UPDATE with the given SET clause on a live post and
+// returns the result. Incrementing in SQL rather than writing back what
+// we read means concurrent increments can't overwrite each other.
+func (s *sqliteStore) addToCounter(ctx context.Context, id, set string, args ...any) (Post, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Post{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx,
+		`UPDATE posts SET `+set+` WHERE id = ? AND deleted_at IS NULL`, append(args, id)...)
+	if err != nil {
+		return Post{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Post{}, err
+	} else if n == 0 {
+		return Post{}, ErrNotFound
+	}
+
+	p, err := getPost(ctx, tx, id)
+	if err != nil {
+		return Post{}, err
+	}
+	return p, tx.Commit()
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, id string, check func(p Post) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if check != nil {
+		p, err := getPost(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if err := check(p); err != nil {
+			return err
+		}
+	}
+
+	ok, err := deletePost(ctx, tx, id, time.Now())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteMany(ctx context.Context, ids []string) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	deleted := []string{}
+	for _, id := range ids {
+		ok, err := deletePost(ctx, tx, id, now)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			deleted = append(deleted, id)
+		}
+	}
+	return deleted, tx.Commit()
+}
+
+func (s *sqliteStore) Restore(ctx context.Context, id string, check func(p Post) error) (Post, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Post{}, err
+	}
+	defer tx.Rollback()
+
+	if check != nil {
+		// getPost skips deleted posts, which are the ones to restore
+		p, err := scanPost(tx.QueryRowContext(ctx, `SELECT `+postColumns+` FROM posts WHERE id = ?`, id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return Post{}, ErrNotFound
+		}
+		if err != nil {
+			return Post{}, err
+		}
+		if err := check(p); err != nil {
+			return Post{}, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE posts SET deleted_at = NULL, updated_at = ? WHERE id = ? AND deleted_at IS NOT NULL`,
+		formatTime(time.Now()), id)
+	if err != nil {
+		return Post{}, err
+	}
+
+	p, err := getPost(ctx, tx, id)
+	if err != nil {
+		return Post{}, err
+	}
+	return p, tx.Commit()
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// queryer is the part of *sql.DB and *sql.Tx the helpers below need, so
+// they can be used both inside and outside a transaction.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// deletePosts deletes the posts matching where, all of them if it's
+// empty, and returns what was deleted.
+func deletePosts(ctx context.Context, tx *sql.Tx, where string, args ...any) ([]Post, error) {
+	rows, err := tx.QueryContext(ctx, `DELETE FROM posts `+where+` RETURNING `+postColumns, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ps []Post
+	for rows.Next() {
+		p, err := scanPost(rows)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, rows.Err()
+}
+
+func insertPost(ctx context.Context, q queryer, p Post) error {
+	_, err := q.ExecContext(ctx,
+		`INSERT INTO posts (`+postColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.ID, p.Title, p.Slug, p.Body, p.Author, p.Owner, formatTags(p.Tags), p.Views, p.Likes, formatAttachment(p.Attachment), formatTime(p.CreatedAt), formatTime(p.UpdatedAt), formatNullTime(p.DeletedAt), formatNullTime(p.ExpiresAt))
+	return err
+}
+
+// assignSlug gives p a slug made from its title that no row has yet.
+func assignSlug(ctx context.Context, q queryer, p *Post) error {
+	var err error
+	p.Slug, err = uniqueSlug(slugify(p.Title), func(slug string) (bool, error) {
+		var taken bool
+		err := q.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM posts WHERE slug = ?)`, slug).Scan(&taken)
+		return taken, err
+	})
+	return err
+}
+
+// deletePost soft deletes a post and drops its comments, reporting whether
+// there was a live post with that ID to delete. q should be a transaction
+// so the two go together.
+func deletePost(ctx context.Context, q queryer, id string, at time.Time) (bool, error) {
+	res, err := q.ExecContext(ctx,
+		`UPDATE posts SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`,
+		formatTime(at), id)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	_, err = q.ExecContext(ctx, `DELETE FROM comments WHERE post_id = ?`, id)
+	return err == nil, err
+}
+
+func getPost(ctx context.Context, q queryer, id string) (Post, error) {
+	p, err := scanPost(q.QueryRowContext(ctx,
+		`SELECT `+postColumns+` FROM posts WHERE id = ? AND deleted_at IS NULL`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Post{}, ErrNotFound
+	}
+	return p, err
+}
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanPost reads a row selected with postColumns.
+func scanPost(row scanner) (Post, error) {
+	var p Post
+	var tags, created, updated string
+	var attachment, deleted, expires sql.NullString
+	if err := row.Scan(&p.ID, &p.Title, &p.Slug, &p.Body, &p.Author, &p.Owner, &tags, &p.Views, &p.Likes, &attachment, &created, &updated, &deleted, &expires); err != nil {
+		return Post{}, err
+	}
+
+	if err := json.Unmarshal([]byte(tags), &p.Tags); err != nil {
+		return Post{}, err
+	}
+	if len(p.Tags) == 0 {
+		p.Tags = nil
+	}
+	if attachment.Valid {
+		if err := json.Unmarshal([]byte(attachment.String), &p.Attachment); err != nil {
+			return Post{}, err
+		}
+	}
+
+	var err error
+	if p.CreatedAt, err = parseTime(created); err != nil {
+		return Post{}, err
+	}
+	if p.UpdatedAt, err = parseTime(updated); err != nil {
+		return Post{}, err
+	}
+	if deleted.Valid {
+		t, err := parseTime(deleted.String)
+		if err != nil {
+			return Post{}, err
+		}
+		p.Deleted, p.DeletedAt = true, &t
+	}
+	if expires.Valid {
+		t, err := parseTime(expires.String)
+		if err != nil {
+			return Post{}, err
+		}
+		p.ExpiresAt = &t
+	}
+	return p, nil
+}
+
+// Timestamps are stored as RFC 3339 text so the database stays readable
+// with the sqlite3 shell.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// formatNullTime is formatTime for nullable columns.
+func formatNullTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return formatTime(*t)
+}
+
+func formatTags(tags []string) string {
+	if tags == nil {
+		tags = []string{}
+	}
+	b, _ := json.Marshal(tags)
+	return string(b)
+}
+
+func formatAttachment(a *Attachment) any {
+	if a == nil {
+		return nil
+	}
+	b, _ := json.Marshal(a)
+	return string(b)
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testStores opens every Store implementation on files in a temp dir.
+// reopen closes a store and opens it again on the same file, to check
+// what survives a restart.
+func testStores(t *testing.T, fn func(t *testing.T, s Store, reopen func(Store) Store)) {
+	for _, kind := range []string{"json", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "posts")
+			open := func() Store {
+				s, err := openStore(kind, path, 10, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+			s := open()
+			t.Cleanup(func() { s.Close() })
+			fn(t, s, func(old Store) Store {
+				if err := old.Close(); err != nil {
+					t.Fatal(err)
+				}
+				s = open()
+				return s
+			})
+		})
+	}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	testStores(t, func(t *testing.T, s Store, reopen func(Store) Store) {
+		a, _, err := s.Create(ctx, Post{Title: "T", Body: "first"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _, err := s.Create(ctx, Post{Title: "T", Body: "second"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.ID == b.ID {
+			t.Fatalf("both posts got ID %v", a.ID)
+		}
+
+		p, err := s.Update(ctx, a.ID, func(p *Post) error {
+			p.Body = "updated"
+			return nil
+		})
+		if err != nil || p.Body != "updated" || p.ID != a.ID {
+			t.Fatalf("Update = %+v, %v", p, err)
+		}
+
+		// An error from fn leaves the post as it was
+		errStop := errors.New("stop")
+		if _, err := s.Update(ctx, a.ID, func(p *Post) error {
+			p.Body = "discarded"
+			return errStop
+		}); err != errStop {
+			t.Fatalf("Update with failing fn = %v, want %v", err, errStop)
+		}
+
+		// check runs before the delete and can veto it
+		if err := s.Delete(ctx, b.ID, func(p Post) error { return errStop }); err != errStop {
+			t.Fatalf("Delete with failing check = %v, want %v", err, errStop)
+		}
+		if _, err := s.Get(ctx, b.ID); err != nil {
+			t.Fatalf("Get after vetoed Delete = %v", err)
+		}
+		if err := s.Delete(ctx, b.ID, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(ctx, b.ID, nil); !errors.Is(err, ErrNotFound) {
+			t.Errorf("second Delete = %v, want ErrNotFound", err)
+		}
+		if _, err := s.Update(ctx, b.ID, func(p *Post) error { return nil }); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Update of deleted post = %v, want ErrNotFound", err)
+		}
+
+		s = reopen(s)
+		if p, err := s.Get(ctx, a.ID); err != nil || p.Body != "updated" {
+			t.Errorf("Get after reopen = %+v, %v", p, err)
+		}
+		if _, err := s.Get(ctx, b.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of deleted post after reopen = %v, want ErrNotFound", err)
+		}
+		if ps, err := s.List(ctx); err != nil || len(ps) != 1 {
+			t.Errorf("List after reopen = %+v, %v", ps, err)
+		}
+	})
+}
+
+func sqliteVersion(t *testing.T, path string) int {
+	t.Helper()
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "posts.db")
+	s, err := newSQLiteStore(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if v := sqliteVersion(t, path); v != len(sqliteMigrations) {
+		t.Fatalf("user_version = %d, want %d", v, len(sqliteMigrations))
+	}
+
+	// A migration whose second statement fails must not leave the first
+	// one applied or the version bumped
+	saved := sqliteMigrations
+	t.Cleanup(func() { sqliteMigrations = saved })
+	sqliteMigrations = append(saved[:len(saved):len(saved)], `CREATE TABLE half (x TEXT); INSERT INTO missing VALUES (1)`)
+	if _, err := newSQLiteStore(path, 10, 0); err == nil {
+		t.Fatal("opening with a broken migration succeeded")
+	}
+	if v := sqliteVersion(t, path); v != len(saved) {
+		t.Errorf("user_version after failed migration = %d, want %d", v, len(saved))
+	}
+
+	sqliteMigrations = append(saved[:len(saved):len(saved)], `CREATE TABLE half (x TEXT)`)
+	s, err = newSQLiteStore(path, 10, 0)
+	if err != nil {
+		t.Fatalf("retrying the fixed migration: %v", err)
+	}
+	s.Close()
+}
+
+// Posts saved before IDs were UUIDs load under the text form of their
+// integer ID, in both stores.
+func TestLegacyIntegerIDs(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	jsonPath := filepath.Join(dir, "posts.json")
+	if err := os.WriteFile(jsonPath, []byte(`[{"id":1,"body":"one"},{"id":2,"body":"two"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := newMemoryStore(jsonPath, 10, 0)
+	if err != nil {
+		t.Fatalf("loading integer IDs: %v", err)
+	}
+	if p, err := ms.Get(ctx, "2"); err != nil || p.Body != "two" {
+		t.Errorf("memory Get(2) = %+v, %v", p, err)
+	}
+	ms.Close()
+
+	// An old file is rewritten with string IDs and still loads
+	ms, err = newMemoryStore(jsonPath, 10, 0)
+	if err != nil {
+		t.Fatalf("reloading: %v", err)
+	}
+	if ps, _ := ms.List(ctx); len(ps) != 2 {
+		t.Errorf("%d posts after reload, want 2", len(ps))
+	}
+
+	// A database at the schema from before the UUID migration
+	dbPath := filepath.Join(dir, "posts.db")
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range append(sqliteMigrations[:2:2],
+		`INSERT INTO posts (body, created_at, updated_at) VALUES ('one', '2024-01-01T00:00:00Z', '2024-01-01T00:00:00Z')`,
+		`PRAGMA user_version = 2`,
+	) {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	ss, err := newSQLiteStore(dbPath, 10, 0)
+	if err != nil {
+		t.Fatalf("migrating: %v", err)
+	}
+	defer ss.Close()
+	if p, err := ss.Get(ctx, "1"); err != nil || p.Body != "one" {
+		t.Errorf("sqlite Get(1) = %+v, %v", p, err)
+	}
+}
+
+func TestStoreSoftDelete(t *testing.T) {
+	ctx := context.Background()
+	testStores(t, func(t *testing.T, s Store, reopen func(Store) Store) {
+		p, _, err := s.Create(ctx, Post{Title: "T", Body: "soon gone"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete(ctx, p.ID, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get(ctx, p.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of deleted post = %v, want ErrNotFound", err)
+		}
+		if ps, _ := s.List(ctx); len(ps) != 0 {
+			t.Errorf("List shows %d deleted posts", len(ps))
+		}
+
+		// Deleted posts stay restorable across a restart
+		s = reopen(s)
+		if _, err := s.Restore(ctx, p.ID, func(Post) error { return ErrForbidden }); !errors.Is(err, ErrForbidden) {
+			t.Errorf("Restore failing its check = %v, want ErrForbidden", err)
+		}
+		got, err := s.Restore(ctx, p.ID, nil)
+		if err != nil || got.Deleted || got.DeletedAt != nil || got.Body != "soon gone" {
+			t.Fatalf("Restore = %+v, %v", got, err)
+		}
+		if _, err := s.Restore(ctx, p.ID, nil); err != nil {
+			t.Errorf("restoring a live post = %v", err)
+		}
+		if _, err := s.Restore(ctx, "missing", nil); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Restore of unknown post = %v, want ErrNotFound", err)
+		}
+		if _, err := s.Get(ctx, p.ID); err != nil {
+			t.Errorf("Get after Restore = %v", err)
+		}
+	})
+}
+
+func TestStoreSlugs(t *testing.T) {
+	ctx := context.Background()
+	testStores(t, func(t *testing.T, s Store, reopen func(Store) Store) {
+		a, _, _ := s.Create(ctx, Post{Title: "Hello, World!", Body: "x"})
+		b, _, _ := s.Create(ctx, Post{Title: "hello world", Body: "x"})
+		if a.Slug != "hello-world" || b.Slug != "hello-world-2" {
+			t.Fatalf("slugs = %q, %q", a.Slug, b.Slug)
+		}
+
+		s = reopen(s)
+		if p, err := s.GetBySlug(ctx, "hello-world-2"); err != nil || p.ID != b.ID {
+			t.Errorf("GetBySlug after reopen = %+v, %v", p, err)
+		}
+		if _, err := s.GetBySlug(ctx, "nope"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetBySlug of unknown slug = %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreComments(t *testing.T) {
+	ctx := context.Background()
+	testStores(t, func(t *testing.T, s Store, reopen func(Store) Store) {
+		p, _, _ := s.Create(ctx, Post{Title: "T", Body: "x"})
+		for _, body := range []string{"first", "second"} {
+			if _, err := s.AddComment(ctx, p.ID, Comment{Body: body}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.AddComment(ctx, "missing", Comment{Body: "x"}); !errors.Is(err, ErrNotFound) {
+			t.Errorf("AddComment on unknown post = %v, want ErrNotFound", err)
+		}
+
+		s = reopen(s)
+		cs, err := s.ListComments(ctx, p.ID)
+		if err != nil || len(cs) != 2 || cs[0].Body != "first" || cs[1].PostID != p.ID {
+			t.Fatalf("ListComments after reopen = %+v, %v", cs, err)
+		}
+
+		// Comments go with the post and don't come back on restore
+		if err := s.Delete(ctx, p.ID, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ListComments(ctx, p.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ListComments of deleted post = %v, want ErrNotFound", err)
+		}
+		if _, err := s.Restore(ctx, p.ID, nil); err != nil {
+			t.Fatal(err)
+		}
+		if cs, _ := s.ListComments(ctx, p.ID); len(cs) != 0 {
+			t.Errorf("restored post has %d comments", len(cs))
+		}
+	})
+}
+
+func TestStoreRevisions(t *testing.T) {
+	ctx := context.Background()
+	testStores(t, func(t *testing.T, s Store, reopen func(Store) Store) {
+		p, _, _ := s.Create(ctx, Post{Title: "T", Body: "v1"})
+		for _, body := range []string{"v2", "v3"} {
+			if _, err := s.Update(ctx, p.ID, func(p *Post) error { p.Body = body; return nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Only body changes make a revision
+		s.Update(ctx, p.ID, func(p *Post) error { p.Title = "New title"; return nil })
+
+		s = reopen(s)
+		revs, err := s.ListRevisions(ctx, p.ID)
+		if err != nil || len(revs) != 2 || revs[0].Body != "v1" || revs[1].Body != "v2" {
+			t.Fatalf("ListRevisions = %+v, %v", revs, err)
+		}
+		if _, err := s.ListRevisions(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("ListRevisions of unknown post = %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestAddRevision(t *testing.T) {
+	var revs []Revision
+	for _, body := range []string{"a", "b", "c"} {
+		revs = addRevision(revs, Revision{Body: body}, 2)
+	}
+	if len(revs) != 2 || revs[0].Body != "b" || revs[1].Body != "c" {
+		t.Errorf("revisions = %+v, want the last 2", revs)
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	ctx := context.Background()
+	for _, kind := range []string{"json", "sqlite"} {
+		t.Run(kind, func(t *testing.T) {
+			s, err := openStore(kind, filepath.Join(t.TempDir(), "posts"), 10, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// Picked IDs break ties between posts created at the same time
+			for _, id := range []string{"a", "b", "c"} {
+				if _, evicted, err := s.Create(ctx, Post{ID: id, Title: id, Body: "x"}); err != nil || len(evicted) != 0 {
+					t.Fatalf("Create %s under the limit = %v, evicted %v", id, err, evicted)
+				}
+			}
+			if _, err := s.AddComment(ctx, "a", Comment{Body: "gone soon"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ctx, "b", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			_, evicted, err := s.Create(ctx, Post{ID: "d", Title: "d", Body: "x"})
+			if err != nil || len(evicted) != 1 || evicted[0].ID != "a" {
+				t.Fatalf("Create over the limit = %v, evicted %+v, want a", err, evicted)
+			}
+			if _, err := s.Get(ctx, "a"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of evicted post = %v, want ErrNotFound", err)
+			}
+			// Deleted posts take up room and are evicted like any other
+			_, evicted, err = s.Create(ctx, Post{ID: "a", Title: "a", Body: "again"})
+			if err != nil || len(evicted) != 1 || evicted[0].ID != "b" || !evicted[0].Deleted {
+				t.Fatalf("Create over the limit = %v, evicted %+v, want the deleted post b", err, evicted)
+			}
+			// The evicted a's comments went with it, the new one has none
+			if cs, err := s.ListComments(ctx, "a"); err != nil || len(cs) != 0 {
+				t.Errorf("comments of a post reusing an evicted ID = %+v, %v", cs, err)
+			}
+
+			// A batch bigger than the limit goes in whole
+			created, evicted, err := s.CreateMany(ctx, []Post{{Title: "e", Body: "x"}, {Title: "f", Body: "x"}, {Title: "g", Body: "x"}, {Title: "h", Body: "x"}})
+			if err != nil || len(created) != 4 || len(evicted) != 3 {
+				t.Fatalf("CreateMany over the limit = %v, created %d, evicted %+v", err, len(created), evicted)
+			}
+			if ids := slices.Sorted(slices.Values(postIDs(evicted))); !slices.Equal(ids, []string{"a", "c", "d"}) {
+				t.Errorf("evicted %v, want every older post", ids)
+			}
+			if ps, _ := s.List(ctx); len(ps) != 4 {
+				t.Errorf("%d posts after a big batch, want all 4 of it", len(ps))
+			}
+
+			// A backup can't go over the limit
+			backup := []Post{{ID: "1", Title: "1"}, {ID: "2", Title: "2"}, {ID: "3", Title: "3"}, {ID: "4", Title: "4"}}
+			if _, err := s.Import(ctx, backup); !errors.Is(err, ErrTooManyPosts) {
+				t.Errorf("Import over the limit = %v, want ErrTooManyPosts", err)
+			}
+			if ps, _ := s.List(ctx); len(ps) != 4 || ps[0].ID == "1" {
+				t.Errorf("failed Import changed the posts to %+v", ps)
+			}
+			if _, err := s.Import(ctx, backup[:3]); err != nil {
+				t.Errorf("Import at the limit = %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreDeleteExpired(t *testing.T) {
+	ctx := context.Background()
+	testStores(t, func(t *testing.T, s Store, reopen func(Store) Store) {
+		now := time.Now()
+		past, future := now.Add(-time.Minute), now.Add(time.Hour)
+		for _, p := range []Post{
+			{ID: "old", Title: "old", ExpiresAt: &past},
+			{ID: "new", Title: "new", ExpiresAt: &future},
+			{ID: "kept", Title: "kept"},
+		} {
+			if _, _, err := s.Create(ctx, p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := s.AddComment(ctx, "old", Comment{Body: "gone soon"}); err != nil {
+			t.Fatal(err)
+		}
+
+		expired, err := s.DeleteExpired(ctx, now)
+		if err != nil || len(expired) != 1 || expired[0].ID != "old" {
+			t.Fatalf("DeleteExpired = %+v, %v, want old", expired, err)
+		}
+		s = reopen(s)
+		if _, err := s.Get(ctx, "old"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get of expired post = %v, want ErrNotFound", err)
+		}
+		if ps, _ := s.List(ctx); len(ps) != 2 {
+			t.Errorf("%d posts left, want new and kept", len(ps))
+		}
+		// A new post under the old ID doesn't inherit its comments
+		if _, _, err := s.Create(ctx, Post{ID: "old", Title: "again"}); err != nil {
+			t.Fatal(err)
+		}
+		if cs, err := s.ListComments(ctx, "old"); err != nil || len(cs) != 0 {
+			t.Errorf("comments of a post reusing an expired ID = %+v, %v", cs, err)
+		}
+		if expired, err := s.DeleteExpired(ctx, now); err != nil || len(expired) != 0 {
+			t.Errorf("second DeleteExpired = %+v, %v, want nothing", expired, err)
+		}
+	})
+}
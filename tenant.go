@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Tenants let one server keep several teams' posts apart. Each tenant
+// named with -tenants gets a store of its own next to the default one, and
+// a request picks its tenant with the X-Tenant-ID header. Requests
+// without one use the default store, as they always have. Everything
+// that's keyed by post ID, comments and revisions included, lives in
+// the tenant's store, so IDs and slugs only have to be unique within a
+// tenant.
+
+const tenantKey contextKey = "tenant"
+
+// validTenant is what a tenant ID has to look like, it ends up in a file
+// name.
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// tenantFrom returns the tenant withTenant resolved for the request, ""
+// for the default one.
+func tenantFrom(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey).(string)
+	return t
+}
+
+// withTenant puts the tenant named by X-Tenant-ID in the request context.
+// A tenant that isn't one of tenants is a 400, rather than quietly using
+// the default store and mixing its data in with someone else's.
+func withTenant(tenants []string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t := r.Header.Get("X-Tenant-ID")
+			if t == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !slices.Contains(tenants, t) {
+				writeError(w, http.StatusBadRequest, "unknown_tenant", "Unknown tenant "+t)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey, t)))
+		})
+	}
+}
+
+// tenantStore is a Store that hands every call to the store of the
+// request's tenant. Handlers keep using s.store and can't forget to pick
+// the right one.
+type tenantStore struct {
+	def     Store
+	tenants map[string]Store
+}
+
+// openTenantStores opens the default store and one for each of tenants.
+// A tenant's data file is the default one with the tenant ID before the
+// extension, posts.acme.db say.
+func openTenantStores(kind, path string, maxRevisions, maxPosts int, tenants []string) (Store, error) {
+	def, err := openStore(kind, path, maxRevisions, maxPosts)
+	if err != nil || len(tenants) == 0 {
+		return def, err
+	}
+
+	ts := &tenantStore{def: def, tenants: make(map[string]Store, len(tenants))}
+	for _, t := range tenants {
+		if !validTenant.MatchString(t) {
+			ts.Close()
+			return nil, errors.New("invalid tenant ID " + t + ", only letters, digits, - and _ are allowed")
+		}
+		p := storePath(kind, path)
+		if p != "" {
+			ext := filepath.Ext(p)
+			p = strings.TrimSuffix(p, ext) + "." + t + ext
+		}
+		s, err := openStore(kind, p, maxRevisions, maxPosts)
+		if err != nil {
+			ts.Close()
+			return nil, fmt.Errorf("tenant %s: %w", t, err)
+		}
+		ts.tenants[t] = s
+	}
+	return ts, nil
+}
+
+func (ts *tenantStore) pick(ctx context.Context) Store {
+	if s, ok := ts.tenants[tenantFrom(ctx)]; ok {
+		return s
+	}
+	return ts.def
+}
+
+func (ts *tenantStore) List(ctx context.Context) ([]Post, error) {
+	return ts.pick(ctx).List(ctx)
+}
+
+func (ts *tenantStore) Get(ctx context.Context, id string) (Post, error) {
+	return ts.pick(ctx).Get(ctx, id)
+}
+
+func (ts *tenantStore) GetBySlug(ctx context.Context, slug string) (Post, error) {
+	return ts.pick(ctx).GetBySlug(ctx, slug)
+}
+
+func (ts *tenantStore) Create(ctx context.Context, p Post) (Post, []Post, error) {
+	return ts.pick(ctx).Create(ctx, p)
+}
+
+func (ts *tenantStore) CreateMany(ctx context.Context, ps []Post) ([]Post, []Post, error) {
+	return ts.pick(ctx).CreateMany(ctx, ps)
+}
+
+func (ts *tenantStore) Update(ctx context.Context, id string, fn func(p *Post) error) (Post, error) {
+	return ts.pick(ctx).Update(ctx, id, fn)
+}
+
+func (ts *tenantStore) ListRevisions(ctx context.Context, postID string) ([]Revision, error) {
+	return ts.pick(ctx).ListRevisions(ctx, postID)
+}
+
+func (ts *tenantStore) AddView(ctx context.Context, id string) (Post, error) {
+	return ts.pick(ctx).AddView(ctx, id)
+}
+
+func (ts *tenantStore) AddLikes(ctx context.Context, id string, delta int64) (Post, error) {
+	return ts.pick(ctx).AddLikes(ctx, id, delta)
+}
+
+func (ts *tenantStore) ListComments(ctx context.Context, postID string) ([]Comment, error) {
+	return ts.pick(ctx).ListComments(ctx, postID)
+}
+
+func (ts *tenantStore) AddComment(ctx context.Context, postID string, c Comment) (Comment, error) {
+	return ts.pick(ctx).AddComment(ctx, postID, c)
+}
+
+func (ts *tenantStore) Delete(ctx context.Context, id string, check func(p Post) error) error {
+	return ts.pick(ctx).Delete(ctx, id, check)
+}
+
+func (ts *tenantStore) DeleteMany(ctx context.Context, ids []string) ([]string, error) {
+	return ts.pick(ctx).DeleteMany(ctx, ids)
+}
+
+func (ts *tenantStore) Restore(ctx context.Context, id string, check func(p Post) error) (Post, error) {
+	return ts.pick(ctx).Restore(ctx, id, check)
+}
+
+func (ts *tenantStore) Export(ctx context.Context, fn func(p Post) error) error {
+	return ts.pick(ctx).Export(ctx, fn)
+}
+
+func (ts *tenantStore) DeleteAll(ctx context.Context) ([]Post, error) {
+	return ts.pick(ctx).DeleteAll(ctx)
+}
+
+func (ts *tenantStore) Import(ctx context.Context, ps []Post) ([]Post, error) {
+	return ts.pick(ctx).Import(ctx, ps)
+}
+
+// DeleteExpired sweeps the tenant in ctx like every other method, the
+// sweep goes through the tenants one at a time so it can tell whose posts
+// it removed.
+func (ts *tenantStore) DeleteExpired(ctx context.Context, now time.Time) ([]Post, error) {
+	return ts.pick(ctx).DeleteExpired(ctx, now)
+}
+
+// Ping checks every tenant's store, we aren't ready until all of them are.
+func (ts *tenantStore) Ping(ctx context.Context) error {
+	if err := ts.def.Ping(ctx); err != nil {
+		return err
+	}
+	for t, s := range ts.tenants {
+		if err := s.Ping(ctx); err != nil {
+			return fmt.Errorf("tenant %s: %w", t, err)
+		}
+	}
+	return nil
+}
+
+func (ts *tenantStore) Close() error {
+	errs := []error{ts.def.Close()}
+	for _, s := range ts.tenants {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
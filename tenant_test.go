@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func newTenantServer(t *testing.T, tenants ...string) http.Handler {
+	t.Helper()
+	ts, err := openTenantStores("sqlite", filepath.Join(t.TempDir(), "posts.db"), 10, 0, tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ts.Close() })
+	h, _ := newUploadServer(t, func(s *server) { s.store = ts })
+	return withTenant(tenants)(h)
+}
+
+func TestTenants(t *testing.T) {
+	h := newTenantServer(t, "acme", "globex")
+	acme := []string{"X-Tenant-ID", "acme"}
+
+	def := createPost(t, h, "Default")
+	rec := do(h, "POST", "/posts", `{"title":"Acme","body":"b"}`, acme...)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /posts for acme = %d %s", rec.Code, rec.Body)
+	}
+	p := decode[Post](t, rec)
+
+	if rec := do(h, "GET", "/post/"+p.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("acme's post without a tenant = %d, want 404", rec.Code)
+	}
+	if rec := do(h, "GET", "/post/"+p.ID, "", "X-Tenant-ID", "globex"); rec.Code != http.StatusNotFound {
+		t.Errorf("acme's post from globex = %d, want 404", rec.Code)
+	}
+	if rec := do(h, "DELETE", "/post/"+def.ID, "", acme...); rec.Code != http.StatusNotFound {
+		t.Errorf("deleting the default tenant's post from acme = %d, want 404", rec.Code)
+	}
+	if ps := decode[[]Post](t, do(h, "GET", "/posts", "", acme...)); len(ps) != 1 || ps[0].ID != p.ID {
+		t.Errorf("acme's posts = %+v, want only %s", ps, p.ID)
+	}
+	if ps := decode[[]Post](t, do(h, "GET", "/posts", "")); len(ps) != 1 || ps[0].ID != def.ID {
+		t.Errorf("default posts = %+v, want only %s", ps, def.ID)
+	}
+	if rec := do(h, "GET", "/posts", "", "X-Tenant-ID", "initech"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown tenant = %d, want 400", rec.Code)
+	}
+
+	// Uploads belong to the tenant they were started in
+	id := startUpload(t, h, acme...)
+	if rec := do(h, "GET", "/uploads/"+id, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("acme's upload without a tenant = %d, want 404", rec.Code)
+	}
+	if rec := do(h, "GET", "/uploads/"+id, "", acme...); rec.Code != http.StatusOK {
+		t.Errorf("acme's upload from acme = %d %s, want 200", rec.Code, rec.Body)
+	}
+	n := strconv.Itoa(len(webm))
+	rec = do(h, "PUT", "/uploads/"+id, webm, "Content-Range", "bytes 0-"+strconv.Itoa(len(webm)-1)+"/"+n, "X-Tenant-ID", "acme")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("finishing acme's upload = %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(h, "GET", "/video/"+id, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("acme's video without a tenant = %d, want 404", rec.Code)
+	}
+	if rec := do(h, "GET", "/video/"+id, "", acme...); rec.Code != http.StatusOK {
+		t.Errorf("acme's video from acme = %d, want 200", rec.Code)
+	}
+}
+
+func TestOpenTenantStores(t *testing.T) {
+	dir := t.TempDir()
+	ts, err := openTenantStores("sqlite", filepath.Join(dir, "posts.db"), 10, 0, []string{"acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	if _, err := os.Stat(filepath.Join(dir, "posts.acme.db")); err != nil {
+		t.Errorf("tenant store file: %v", err)
+	}
+
+	if _, err := openTenantStores("memory", "", 10, 0, []string{"../etc"}); err == nil {
+		t.Error("tenant ID with a path in it was accepted")
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Attachment is a file uploaded together with a post. The file itself
+// lives in the server's upload directory.
+type Attachment struct {
+	// Path is the file's name inside the upload directory. The server
+	// makes it up, it's never taken from the client.
+	Path        string `json:"path" xml:"path"`
+	Name        string `json:"name,omitempty" xml:"name,omitempty"`
+	ContentType string `json:"content_type" xml:"content_type"`
+	Size        int64  `json:"size" xml:"size"`
+}
+
+var (
+	errFileTooLarge = errors.New("file too large")
+	errFileType     = errors.New("file type not allowed")
+)
+
+// handleUploadPost creates a post from a multipart/form-data body. The
+// "post" field holds the post as JSON, the optional "file" field is saved
+// to the upload directory and attached to the post.
+func (s *server) handleUploadPost(w http.ResponseWriter, r *http.Request) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing multipart body")
+		return
+	}
+
+	var body []byte
+	var att *Attachment
+	// The file is only kept once a post points at it
+	defer func() {
+		if att != nil {
+			s.files.Delete(context.WithoutCancel(r.Context()), att.Path)
+		}
+	}()
+
+	sum := sha256.New()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.writeUploadError(w, err)
+			return
+		}
+
+		switch name := part.FormName(); {
+		case name == "post" && body == nil:
+			body, err = io.ReadAll(part)
+		case name == "file" && att == nil:
+			att, err = s.saveUpload(r.Context(), part, sum)
+		default:
+			writeError(w, http.StatusBadRequest, "invalid_body", fmt.Sprintf("Unexpected multipart field %q", name))
+			return
+		}
+		if err != nil {
+			s.writeUploadError(w, err)
+			return
+		}
+	}
+
+	// A signed body is only checked once it's been read to the end
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		s.writeUploadError(w, err)
+		return
+	}
+
+	if body == nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", `Multipart body has no "post" field`)
+		return
+	}
+
+	var p Post
+	if err := json.Unmarshal(body, &p); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error parsing post")
+		return
+	}
+	if err := validatePost(p); err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	p.Attachment = att
+
+	// A retry with the same Idempotency-Key has to send the same file too
+	if att != nil {
+		body = sum.Sum(body)
+	}
+	if s.handleCreatePost(w, r, p, body) {
+		att = nil
+	}
+}
+
+// saveUpload streams an uploaded file into storage, and into sum on the
+// way. Files of a type we don't take or over the size limit are refused.
+func (s *server) saveUpload(ctx context.Context, part *multipart.Part, sum hash.Hash) (*Attachment, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	ct := uploadType(head, part.Header.Get("Content-Type"))
+	if !uploadTypeAllowed(s.uploadTypes, ct) {
+		return nil, errFileType
+	}
+
+	att := &Attachment{
+		Path:        uuid.NewString() + uploadExt(part.FileName()),
+		Name:        part.FileName(),
+		ContentType: ct,
+	}
+	src := &readTracker{r: io.LimitReader(io.MultiReader(bytes.NewReader(head), part), s.maxUpload+1)}
+	att.Size, err = s.files.Put(ctx, att.Path, io.TeeReader(src, sum))
+	if src.err != nil {
+		return nil, src.err
+	}
+	if err != nil {
+		return nil, &storageError{err}
+	}
+	if att.Size > s.maxUpload {
+		s.files.Delete(ctx, att.Path)
+		return nil, errFileTooLarge
+	}
+	return att, nil
+}
+
+// readTracker remembers the error reading from r, so a failed Put can be
+// told apart from a client that stopped sending.
+type readTracker struct {
+	r   io.Reader
+	err error
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF {
+		t.err = err
+	}
+	return n, err
+}
+
+// storageError wraps an error from the StorageBackend, to tell it apart
+// from an error in what the client sent.
+type storageError struct {
+	err error
+}
+
+func (e *storageError) Error() string { return e.err.Error() }
+func (e *storageError) Unwrap() error { return e.err }
+
+// handleGetPostFile serves a post's attachment. http.ServeContent takes
+// care of Range requests, so players can seek in audio and video, and of
+// conditional requests against the file's modification time.
+func (s *server) handleGetPostFile(w http.ResponseWriter, r *http.Request, id string) {
+	p, err := s.store.Get(r.Context(), id)
+	if err == nil && !s.canRead(r.Context(), p) {
+		err = ErrNotFound
+	}
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	if p.Attachment == nil {
+		writeError(w, http.StatusNotFound, "not_found", "Post has no file")
+		return
+	}
+
+	f, info, err := s.files.Get(r.Context(), p.Attachment.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "not_found", "File not found")
+		return
+	}
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	defer f.Close()
+
+	setFileHeaders(w.Header(), p.Attachment.ContentType, p.Attachment.Name)
+	// Big files take longer than -write-timeout to send to a slow client
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	http.ServeContent(w, r, p.Attachment.Path, info.ModTime, f)
+}
+
+// setFileHeaders sets the headers for serving an uploaded file of type ct,
+// named name if it isn't empty. The file comes from our own origin, so
+// whatever it turns out to be mustn't get to run scripts there. Only what
+// a browser can't do more with than show is served inline, anything else
+// is a download.
+func setFileHeaders(h http.Header, ct, name string) {
+	h.Set("Content-Type", ct)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "sandbox")
+	disposition := "attachment"
+	if servedInline(ct) {
+		disposition = "inline"
+	}
+	params := map[string]string{}
+	if name != "" {
+		params["filename"] = name
+	}
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, params))
+}
+
+// inlineTypes are the raster image types setFileHeaders lets a browser
+// show in place.
+var inlineTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp", "image/avif"}
+
+func servedInline(ct string) bool {
+	return slices.Contains(inlineTypes, ct)
+}
+
+// writeUploadError sends the response for an error reading an uploaded
+// file. Failing to write the file is our problem, anything else is the
+// client's.
+func (s *server) writeUploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	var storeErr *storageError
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.Is(err, errSignature):
+		writeSignatureError(w)
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, "body_too_large", "Request body too large")
+	case errors.Is(err, errFileTooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, "file_too_large", fmt.Sprintf("File is larger than %d bytes", s.maxUpload))
+	case errors.Is(err, errFileType):
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_file_type", "Files of this type can't be uploaded")
+	case errors.As(err, &storeErr), errors.As(err, &pathErr), errors.As(err, &linkErr):
+		logger.Printf("error saving upload: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal_error", "Error saving file")
+	default:
+		writeError(w, http.StatusBadRequest, "invalid_body", "Error reading request body")
+	}
+}
+
+// uploadType works out the type of a file that starts with head. What
+// the file starts with beats what the client says it is. Only when
+// sniffing can't tell, which it can't for plenty of video formats, do we
+// go by the declared type.
+func uploadType(head []byte, declared string) string {
+	ct, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if ct == "application/octet-stream" {
+		if d, _, _ := mime.ParseMediaType(declared); d != "" {
+			ct = d
+		}
+	}
+	return ct
+}
+
+// deleteAttachments removes the files of posts that are gone for good,
+// except for files one of keep still points at.
+func (s *server) deleteAttachments(ctx context.Context, gone, keep []Post) {
+	kept := make(map[string]bool)
+	for _, p := range keep {
+		if p.Attachment != nil {
+			kept[p.Attachment.Path] = true
+		}
+	}
+	for _, p := range gone {
+		if p.Attachment == nil || kept[p.Attachment.Path] {
+			continue
+		}
+		if err := s.files.Delete(context.WithoutCancel(ctx), p.Attachment.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("error deleting file %s of post %s: %v", p.Attachment.Path, p.ID, err)
+		}
+	}
+}
+
+// isUpload reports whether r carries a file, either as a multipart POST or
+// as a chunk of a resumable upload. withMaxBody gives those a bigger limit.
+func isUpload(r *http.Request) bool {
+	switch r.Method {
+	case "POST":
+		return contentType(r) == "multipart/form-data"
+	case "PUT":
+		return r.Header.Get("Content-Range") != ""
+	}
+	return false
+}
+
+// uploadTypeAllowed reports whether ct matches one of allowed, where an
+// entry like "video/*" matches every video type. SVG never is, whatever
+// -upload-types says: it's an image that can carry scripts.
+func uploadTypeAllowed(allowed []string, ct string) bool {
+	if ct == "image/svg+xml" {
+		return false
+	}
+	for _, a := range allowed {
+		if prefix, ok := strings.CutSuffix(a, "/*"); ok {
+			if strings.HasPrefix(ct, prefix+"/") {
+				return true
+			}
+		} else if a == ct {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadExt keeps the extension of the client's file name, so the stored
+// file still looks like what it is, as long as it's a plain one.
+func uploadExt(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if len(ext) < 2 || len(ext) > 10 {
+		return ""
+	}
+	for _, c := range ext[1:] {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return ""
+		}
+	}
+	return ext
+}
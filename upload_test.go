@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// webm is enough of a WebM header for http.DetectContentType to know it.
+const webm = "\x1a\x45\xdf\xa3 rest of the video"
+
+// newUploadServer is newTestServer with uploads going to a temporary
+// directory, which it returns too.
+func newUploadServer(t *testing.T, configure ...func(s *server)) (http.Handler, string) {
+	dir := t.TempDir()
+	configure = append([]func(s *server){func(s *server) {
+		s.uploadDir, s.maxUpload, s.uploadTypes = dir, 1<<10, []string{"video/*", "image/*"}
+		s.files = newDiskStorage(dir)
+	}}, configure...)
+	return newTestServer(t, configure...), dir
+}
+
+// multipartPost builds a POST /posts upload of post with a file of the
+// given declared type and contents. An empty contentType leaves the file
+// out.
+func multipartPost(t *testing.T, post, contentType, contents string) (body, formType string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("post", post); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="clip.webm"`)
+		h.Set("Content-Type", contentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(contents))
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), mw.FormDataContentType()
+}
+
+func uploadPost(t *testing.T, h http.Handler, contentType, contents string) Post {
+	t.Helper()
+	body, ct := multipartPost(t, `{"title":"Clip","body":"watch this"}`, contentType, contents)
+	rec := do(h, "POST", "/posts", body, "Content-Type", ct)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload = %d %s, want 201", rec.Code, rec.Body)
+	}
+	return decode[Post](t, rec)
+}
+
+func TestUpload(t *testing.T) {
+	h, dir := newUploadServer(t)
+
+	p := uploadPost(t, h, "application/octet-stream", webm)
+	a := p.Attachment
+	if a == nil || a.ContentType != "video/webm" || a.Size != int64(len(webm)) || a.Name != "clip.webm" {
+		t.Fatalf("attachment = %+v", a)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, a.Path)); err != nil || string(data) != webm {
+		t.Errorf("stored file = %q, %v", data, err)
+	}
+
+	// Sniffing can't place raw frames, so the declared type counts
+	if p := uploadPost(t, h, "video/mp4", "\x01\x02\x03\x04"); p.Attachment.ContentType != "video/mp4" {
+		t.Errorf("unsniffable file stored as %q, want the declared video/mp4", p.Attachment.ContentType)
+	}
+	if p := uploadPost(t, h, "", ""); p.Attachment != nil {
+		t.Errorf("post without a file has attachment %+v", p.Attachment)
+	}
+
+	for _, tc := range []struct {
+		name, contentType, contents string
+		want                        int
+	}{
+		{"html posing as video", "video/mp4", "<html><script>alert(1)</script></html>", http.StatusUnsupportedMediaType},
+		{"svg", "image/svg+xml", "\x01\x02\x03\x04", http.StatusUnsupportedMediaType},
+		{"too large", "video/webm", webm + string(make([]byte, 1<<10)), http.StatusRequestEntityTooLarge},
+	} {
+		body, ct := multipartPost(t, `{"title":"Clip","body":"x"}`, tc.contentType, tc.contents)
+		if rec := do(h, "POST", "/posts", body, "Content-Type", ct); rec.Code != tc.want {
+			t.Errorf("%s: upload = %d %s, want %d", tc.name, rec.Code, rec.Body, tc.want)
+		}
+	}
+
+	// A post that fails validation doesn't leave its file behind
+	body, ct := multipartPost(t, `{"body":"no title"}`, "video/webm", webm)
+	if rec := do(h, "POST", "/posts", body, "Content-Type", ct); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid post upload = %d, want 422", rec.Code)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("upload dir has %d files, want the 2 attached ones", len(files))
+	}
+}
+
+func TestUploadCleanup(t *testing.T) {
+	h, dir := newUploadServer(t, func(s *server) { s.allowDeleteAll = true })
+	exists := func(p Post) bool {
+		_, err := os.Stat(filepath.Join(dir, p.Attachment.Path))
+		return err == nil
+	}
+
+	a := uploadPost(t, h, "video/webm", webm)
+	b := uploadPost(t, h, "video/webm", webm)
+	backup, _ := json.Marshal([]Post{a})
+	if rec := do(h, "POST", "/admin/restore", string(backup)); rec.Code != http.StatusOK {
+		t.Fatalf("restore = %d %s", rec.Code, rec.Body)
+	}
+	if !exists(a) || exists(b) {
+		t.Errorf("after restoring only a: a's file kept %v, b's file kept %v", exists(a), exists(b))
+	}
+
+	if rec := do(h, "DELETE", "/posts", ""); rec.Code != http.StatusOK {
+		t.Fatalf("DELETE /posts = %d %s", rec.Code, rec.Body)
+	}
+	if exists(a) {
+		t.Error("DELETE /posts left a's file behind")
+	}
+
+	// Evicting a post to stay under -max-posts deletes its file too
+	s, err := newMemoryStore("", 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, dir = newUploadServer(t, func(srv *server) { srv.store = s })
+	c := uploadPost(t, h, "video/webm", webm)
+	createPost(t, h, "Evicts c")
+	if exists(c) {
+		t.Error("eviction left c's file behind")
+	}
+}
+
+func TestGetPostFile(t *testing.T) {
+	h, _ := newUploadServer(t)
+	p := uploadPost(t, h, "video/webm", webm)
+
+	rec := do(h, "GET", "/post/"+p.ID+"/file", "")
+	if rec.Code != http.StatusOK || rec.Body.String() != webm {
+		t.Fatalf("GET file = %d %q", rec.Code, rec.Body)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":            "video/webm",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+		"Content-Disposition":     `attachment; filename=clip.webm`,
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	rec = do(h, "GET", "/post/"+p.ID+"/file", "", "Range", "bytes=0-3")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != webm[:4] {
+		t.Errorf("ranged GET = %d %q", rec.Code, rec.Body)
+	}
+
+	// Raster images are the only thing shown inline
+	img := uploadPost(t, h, "image/png", "\x89PNG\r\n\x1a\n pixels")
+	rec = do(h, "GET", "/post/"+img.ID+"/file", "")
+	if got := rec.Header().Get("Content-Disposition"); got != `inline; filename=clip.webm` {
+		t.Errorf("image Content-Disposition = %q, want inline", got)
+	}
+
+	if rec := do(h, "GET", "/post/"+createPost(t, h, "No file").ID+"/file", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("GET file of post without one = %d, want 404", rec.Code)
+	}
+}
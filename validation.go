@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The longest title, body and tag allowed. They're counted in characters,
+// not bytes, so posts in Japanese get as much room as posts in English.
+const (
+	maxTitleLength = 200
+	maxBodyLength  = 20000
+	maxTagLength   = 50
+)
+
+// ValidationError reports a post that breaks one of our rules.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// validatePost checks the fields clients control. It's run on every create
+// and on the result of every update. Every broken rule is reported, so a
+// form can flag all its bad fields at once, as *ValidationErrors joined
+// with errors.Join.
+func validatePost(p Post) error {
+	var errs []error
+	if strings.TrimSpace(p.Title) == "" {
+		errs = append(errs, &ValidationError{Field: "title", Message: "must not be empty"})
+	} else if utf8.RuneCountInString(p.Title) > maxTitleLength {
+		errs = append(errs, &ValidationError{Field: "title", Message: "must be at most " + strconv.Itoa(maxTitleLength) + " characters"})
+	}
+	if strings.TrimSpace(p.Body) == "" {
+		errs = append(errs, &ValidationError{Field: "body", Message: "must not be empty"})
+	} else if utf8.RuneCountInString(p.Body) > maxBodyLength {
+		errs = append(errs, &ValidationError{Field: "body", Message: "must be at most " + strconv.Itoa(maxBodyLength) + " characters"})
+	}
+	for _, t := range p.Tags {
+		if utf8.RuneCountInString(strings.TrimSpace(t)) > maxTagLength {
+			errs = append(errs, &ValidationError{Field: "tags", Message: "must each be at most " + strconv.Itoa(maxTagLength) + " characters"})
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// maxIDLength is the longest ID a client can pick for a new post.
+const maxIDLength = 64
+
+// validatePostID checks an ID a client picked for a new post, an empty
+// one means we pick. IDs end up in URLs so they're kept to letters,
+// digits, - and _, and "slug" is out since /post/slug/ finds posts by
+// slug.
+func validatePostID(id string) error {
+	if id == "" {
+		return nil
+	}
+	if len(id) > maxIDLength {
+		return &ValidationError{Field: "id", Message: "must be at most " + strconv.Itoa(maxIDLength) + " characters"}
+	}
+	if id == "slug" {
+		return &ValidationError{Field: "id", Message: `must not be "slug"`}
+	}
+	for _, c := range id {
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return &ValidationError{Field: "id", Message: "may only contain letters, digits, - and _"}
+		}
+	}
+	return nil
+}
+
+// validationErrors digs the *ValidationErrors out of err, which can be a
+// single one or several joined together.
+func validationErrors(err error) []*ValidationError {
+	switch e := err.(type) {
+	case *ValidationError:
+		return []*ValidationError{e}
+	case interface{ Unwrap() []error }:
+		var out []*ValidationError
+		for _, err := range e.Unwrap() {
+			out = append(out, validationErrors(err)...)
+		}
+		return out
+	}
+	if err = errors.Unwrap(err); err != nil {
+		return validationErrors(err)
+	}
+	return nil
+}
+
+// writeJSON sends v as the JSON response body with the given status.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// validationAPIError turns an error from validatePost into the body of a
+// 422 response. Field and Message describe the first broken rule, Details
+// lists all of them.
+func validationAPIError(err error) APIError {
+	e := APIError{Code: "invalid_post", Message: err.Error()}
+	invalid := validationErrors(err)
+	if len(invalid) == 0 {
+		return e
+	}
+	e.Field, e.Message = invalid[0].Field, invalid[0].Error()
+	if len(invalid) > 1 {
+		e.Message = strconv.Itoa(len(invalid)) + " fields are invalid"
+	}
+	for _, v := range invalid {
+		e.Details = append(e.Details, FieldError{Field: v.Field, Message: v.Message})
+	}
+	return e
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// The API is served under /v1 as well as without a prefix. The unprefixed
+// routes are the API as it was before versioning and only stay around
+// until clients have moved over, so changes that would break a client go
+// into /v1, behind a check of apiPrefix.
+
+const apiPrefixKey contextKey = "api_prefix"
+
+// versioned serves h under prefix. h sees the path without it and can find
+// it again with apiPrefix.
+func versioned(prefix string, h http.Handler) http.Handler {
+	return http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiPrefixKey, prefix)))
+	}))
+}
+
+// apiPrefix returns the version prefix the request came in under, "" for
+// the unprefixed routes. Links back into the API start with it, so
+// clients stay on the version they picked.
+func apiPrefix(ctx context.Context) string {
+	p, _ := ctx.Value(apiPrefixKey).(string)
+	return p
+}
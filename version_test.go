@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVersioned(t *testing.T) {
+	h := newTestServer(t)
+	v1 := versioned("/v1", h)
+
+	rec := do(v1, "POST", "/v1/posts", `{"title":"Versioned","body":"b"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /v1/posts = %d %s", rec.Code, rec.Body)
+	}
+	p := decode[Post](t, rec)
+	if loc := rec.Header().Get("Location"); loc != "/v1/post/"+p.ID {
+		t.Errorf("Location = %q, want it under /v1", loc)
+	}
+	if rec := do(v1, "GET", "/v1/post/"+p.ID, ""); rec.Code != http.StatusOK {
+		t.Errorf("GET under /v1 = %d, want 200", rec.Code)
+	}
+
+	// Links for paging keep the prefix too
+	createPost(t, h, "Second")
+	rec = do(v1, "GET", "/v1/posts?limit=1", "")
+	if link := rec.Header().Get("Link"); !strings.HasPrefix(link, "</v1/") {
+		t.Errorf("Link = %q, want it under /v1", link)
+	}
+	if loc := do(h, "POST", "/posts", `{"title":"Plain","body":"b"}`).Header().Get("Location"); !strings.HasPrefix(loc, "/post/") {
+		t.Errorf("unprefixed Location = %q", loc)
+	}
+}
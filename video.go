@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// videoHandler streams media finished through a resumable upload, see
+// resumable.go. http.ServeContent answers Range requests with 206 Partial
+// Content, so browsers can seek without downloading the whole file.
+func (s *server) videoHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if u, err := uuid.Parse(id); err != nil || u.String() != id {
+		writeError(w, http.StatusNotFound, "not_found", "Video not found")
+		return
+	}
+
+	f, info, err := s.files.Get(r.Context(), mediaKey(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusNotFound, "not_found", "Video not found")
+		return
+	}
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	defer f.Close()
+
+	// The file has no extension to go by, the type it was accepted as is
+	// in its meta file
+	m, err := s.readUploadMeta(id)
+	if err != nil {
+		handleStoreError(w, err)
+		return
+	}
+	if m.Tenant != tenantFrom(r.Context()) {
+		writeError(w, http.StatusNotFound, "not_found", "Video not found")
+		return
+	}
+
+	setFileHeaders(w.Header(), m.ContentType, "")
+	// Watching a long video takes longer than -write-timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	http.ServeContent(w, r, id, info.ModTime, f)
+}
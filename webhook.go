@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookTimeout is how long each attempt at delivering a webhook gets
+	webhookTimeout = 5 * time.Second
+	// webhookBackoff is the wait before the first retry, doubled for each
+	// one after that
+	webhookBackoff = 500 * time.Millisecond
+	// webhookWorkers is how many deliveries are made at once
+	webhookWorkers = 4
+	// webhookQueue is how many deliveries can wait for a worker. A bulk
+	// import bigger than that while the other end is slow loses some.
+	webhookQueue = 1000
+)
+
+// webhook tells another system about new posts by POSTing them to its URL.
+// Delivery happens in the background, the client that created the post
+// doesn't wait for it, and a post the other end never heard about is only
+// logged. A fixed set of workers does the delivering, so a big bulk create
+// doesn't turn into as many requests at once.
+type webhook struct {
+	url     string
+	retries int
+	client  *http.Client
+
+	mu     sync.Mutex
+	queue  chan webhookDelivery
+	closed bool
+	// workers lets shutdown wait for deliveries that are still going
+	workers sync.WaitGroup
+}
+
+type webhookDelivery struct {
+	postID string
+	tenant string
+	body   []byte
+}
+
+func newWebhook(url string, retries int) *webhook {
+	h := &webhook{
+		url:     url,
+		retries: retries,
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan webhookDelivery, webhookQueue),
+	}
+	h.workers.Add(webhookWorkers)
+	for range webhookWorkers {
+		go func() {
+			defer h.workers.Done()
+			for d := range h.queue {
+				h.send(d)
+			}
+		}()
+	}
+	return h
+}
+
+// postCreated queues p for delivery. The tenant goes along in X-Tenant-ID
+// so the other end can tell whose post it is.
+func (h *webhook) postCreated(p Post, tenant string) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		logger.Printf("error encoding webhook for post %s: %v", p.ID, err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	select {
+	case h.queue <- webhookDelivery{postID: p.ID, tenant: tenant, body: body}:
+	default:
+		logger.Printf("error delivering webhook for post %s: %d deliveries already waiting", p.ID, webhookQueue)
+	}
+}
+
+// send makes a delivery, retrying with backoff.
+func (h *webhook) send(d webhookDelivery) {
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		err := h.deliver(d.body, d.tenant)
+		if err == nil {
+			return
+		}
+		if attempt == h.retries {
+			logger.Printf("error delivering webhook for post %s, giving up after %d attempts: %v", d.postID, attempt+1, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (h *webhook) deliver(body []byte, tenant string) error {
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		req.Header.Set("X-Tenant-ID", tenant)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", h.url, resp.Status)
+	}
+	return nil
+}
+
+// wait stops taking deliveries and blocks until the queued ones have
+// finished or ctx is done.
+func (h *webhook) wait(ctx context.Context) error {
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// notifyCreated sends the webhook for a post r just created, if there is
+// one.
+func (s *server) notifyCreated(r *http.Request, p Post) {
+	if s.webhook != nil {
+		s.webhook.postCreated(p, tenantFrom(r.Context()))
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var got []Post
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			// The first delivery gets retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Post
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("X-Tenant-ID") != "acme" {
+			t.Errorf("X-Tenant-ID = %q, want acme", r.Header.Get("X-Tenant-ID"))
+		}
+		got = append(got, p)
+	}))
+	defer ts.Close()
+
+	h := newWebhook(ts.URL, 1)
+	h.postCreated(Post{ID: "1", Title: "Hooked"}, "acme")
+	if err := h.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is taken once shutdown started
+	h.postCreated(Post{ID: "2"}, "acme")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 || len(got) != 1 || got[0].Title != "Hooked" {
+		t.Errorf("%d calls delivered %+v, want post 1 after a retry", calls, got)
+	}
+}
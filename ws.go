@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait is how long writing one message to a WebSocket may take
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long a client may go without answering our pings
+	// before we give up on it
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod has to be shorter than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	// wsMaxMessage is the largest message a client may send, commands are
+	// tiny
+	wsMaxMessage = 4096
+)
+
+// wsCommand is what a client sends over /ws. Its action is subscribe or
+// unsubscribe, for the post with the given ID.
+type wsCommand struct {
+	Action string `json:"action"`
+	ID     string `json:"id"`
+}
+
+// wsFilter is which posts a socket is subscribed to. With none it gets
+// every event, like GET /posts/events.
+type wsFilter struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (f *wsFilter) set(id string, on bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if on {
+		f.ids[id] = true
+	} else {
+		delete(f.ids, id)
+	}
+}
+
+func (f *wsFilter) wants(e PostEvent) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.ids) == 0 || e.Type == "reset" || f.ids[e.ID]
+}
+
+// wsCheckOrigin lets browsers connect from the origins CORS allows, as
+// well as from our own. Anything else could be a page using a visitor's
+// cookies against us.
+func (s *server) wsCheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(s.origins, "*") || slices.Contains(s.origins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// handleWebSocket pushes the same events as GET /posts/events as JSON
+// messages over a WebSocket. A socket starts out getting every event, or
+// only those for the post in ?id=, and can subscribe to and unsubscribe
+// from single posts with wsCommands as it goes.
+func (s *server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: s.wsCheckOrigin,
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			writeError(w, status, "websocket_failed", reason.Error())
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	releaseSlot(r)
+
+	filter := &wsFilter{ids: make(map[string]bool)}
+	if id := r.URL.Query().Get("id"); id != "" {
+		filter.set(id, true)
+	}
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	// Only this goroutine reads, the handler's is the only one that writes
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(wsMaxMessage)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				// Closed by the client, or it stopped answering pings
+				return
+			}
+			var cmd wsCommand
+			if json.Unmarshal(msg, &cmd) != nil {
+				continue
+			}
+			switch cmd.Action {
+			case "subscribe":
+				filter.set(cmd.ID, true)
+			case "unsubscribe":
+				filter.set(cmd.ID, false)
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				// Too slow to keep up or we're shutting down
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if !s.eventVisible(r, e) || !filter.wants(e) {
+				continue
+			}
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		}
+	}
+}
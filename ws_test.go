@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	sem := make(chan struct{}, 1)
+	h := withConcurrencyLimit(sem)(newTestServer(t))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	watched := createPost(t, h, "Watched")
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?id="+watched.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// The socket gave its slot back, or these would be 503s
+	createPost(t, h, "Unwatched")
+	if rec := do(h, "PATCH", "/post/"+watched.ID, `{"title":"Changed"}`); rec.Code != 200 {
+		t.Fatalf("PATCH = %d %s", rec.Code, rec.Body)
+	}
+	var e PostEvent
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != "updated" || e.ID != watched.ID || e.Post == nil || e.Post.Title != "Changed" {
+		t.Errorf("first event = %+v, want the update of the watched post", e)
+	}
+
+	// Subscribing to more posts gets their events too
+	other := createPost(t, h, "Other")
+	if err := conn.WriteJSON(wsCommand{Action: "subscribe", ID: other.ID}); err != nil {
+		t.Fatal(err)
+	}
+	// The command is read in the background, so change both posts until
+	// the other one's event comes before the watched one's
+	for seen := false; !seen; {
+		do(h, "PATCH", "/post/"+other.ID, `{"body":"again"}`)
+		do(h, "PATCH", "/post/"+watched.ID, `{"body":"again"}`)
+		for e.ID = ""; e.ID != watched.ID; {
+			if err := conn.ReadJSON(&e); err != nil {
+				t.Fatalf("no event for %s after subscribing: %v", other.ID, err)
+			}
+			seen = seen || e.ID == other.ID
+		}
+	}
+}